@@ -0,0 +1,224 @@
+package trapwords
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// requireAdmin only lets through requests carrying the admin token as
+// a bearer token. With no token configured the admin API is disabled.
+func (s *Server) requireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if s.Config.AdminToken == "" {
+			writeError(rw, http.StatusNotFound, "not_found", "No such endpoint")
+			return
+		}
+		token, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(s.Config.AdminToken)) != 1 {
+			rw.Header().Set("WWW-Authenticate", `Bearer realm="trapwords admin"`)
+			writeError(rw, http.StatusUnauthorized, "unauthorized", "Send the admin token as a bearer token")
+			return
+		}
+		next.ServeHTTP(rw, req)
+	})
+}
+
+// handleAdmin routes the admin API:
+//
+//	GET    /admin/games           list every game
+//	GET    /admin/games/<id>      one game's full state, including hidden words
+//	DELETE /admin/games/<id>      delete a game
+//	POST   /admin/games/<id>/end  end a game now, optionally naming a winner
+//	POST   /admin/cleanup         remove expired games now
+//	GET    /admin/export          records of games that finished between from and to
+func (s *Server) handleAdmin(rw http.ResponseWriter, req *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(req.URL.Path, "/admin/"), "/"), "/")
+
+	switch {
+	case len(parts) == 1 && parts[0] == "games":
+		if allowAPIMethod(rw, req, "GET") {
+			s.handleAdminListGames(rw, req)
+		}
+	case len(parts) == 2 && parts[0] == "games":
+		setGameID(req, parts[1])
+		if allowAPIMethod(rw, req, "GET", "DELETE") {
+			if req.Method == "DELETE" {
+				s.handleAdminDeleteGame(rw, req, parts[1])
+			} else {
+				s.handleAdminGetGame(rw, req, parts[1])
+			}
+		}
+	case len(parts) == 3 && parts[0] == "games" && parts[2] == "end":
+		setGameID(req, parts[1])
+		if allowAPIMethod(rw, req, "POST") {
+			s.handleAdminEndGame(rw, req, parts[1])
+		}
+	case len(parts) == 1 && parts[0] == "cleanup":
+		if allowAPIMethod(rw, req, "POST") {
+			s.handleAdminCleanup(rw, req)
+		}
+	case len(parts) == 1 && parts[0] == "export":
+		if allowAPIMethod(rw, req, "GET") {
+			s.handleAdminExport(rw, req)
+		}
+	default:
+		writeError(rw, http.StatusNotFound, "not_found", "No such endpoint")
+	}
+}
+
+type adminGameSummary struct {
+	ID         string    `json:"id"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastActive time.Time `json:"last_active"`
+	Phase      Phase     `json:"phase"`
+	Round      int       `json:"round"`
+	// PlayerCount is how many players are in the game, not counting
+	// spectators or anyone who has left.
+	PlayerCount int    `json:"player_count"`
+	WordSource  string `json:"word_source"`
+	WinningTeam *Team  `json:"winning_team,omitempty"`
+}
+
+func (s *Server) summarize(g *Game) adminGameSummary {
+	return adminGameSummary{
+		ID:          g.ID,
+		CreatedAt:   g.CreatedAt,
+		LastActive:  g.lastActive(),
+		Phase:       g.Phase(),
+		Round:       g.Round,
+		PlayerCount: len(g.playerList(s.now())),
+		WordSource:  g.WordSource,
+		WinningTeam: g.WinningTeam,
+	}
+}
+
+func (s *Server) handleAdminListGames(rw http.ResponseWriter, req *http.Request) {
+	games := []adminGameSummary{}
+	for _, e := range s.games.snapshot() {
+		e.mu.Lock()
+		games = append(games, s.summarize(e.game))
+		e.mu.Unlock()
+	}
+	sort.Slice(games, func(i, j int) bool {
+		return games[i].CreatedAt.Before(games[j].CreatedAt)
+	})
+	writeJSON(rw, struct {
+		Games []adminGameSummary `json:"games"`
+	}{games})
+}
+
+type adminGameDetail struct {
+	*Game
+	StateID     string   `json:"state_id"`
+	Phase       Phase    `json:"phase"`
+	PlayerCount int      `json:"player_count"`
+	WordSource  string   `json:"word_source"`
+	WordList    []string `json:"word_list"`
+}
+
+func (s *Server) handleAdminGetGame(rw http.ResponseWriter, req *http.Request, id string) {
+	e, ok := s.games.get(id)
+	if !ok {
+		writeError(rw, http.StatusNotFound, "game_not_found", "No such game")
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	writeJSON(rw, s.detail(e.game))
+}
+
+func (s *Server) detail(g *Game) adminGameDetail {
+	return adminGameDetail{
+		Game:        g,
+		StateID:     g.GameState.ID(),
+		Phase:       g.Phase(),
+		PlayerCount: len(g.playerList(s.now())),
+		WordSource:  g.WordSource,
+		WordList:    g.Words,
+	}
+}
+
+func (s *Server) handleAdminDeleteGame(rw http.ResponseWriter, req *http.Request, id string) {
+	e, ok := s.games.get(id)
+	if !ok || !s.deleteGame(id, e) {
+		writeError(rw, http.StatusNotFound, "game_not_found", "No such game")
+		return
+	}
+	s.logFor(req).Info("admin deleted game", "game_id", id)
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) handleAdminEndGame(rw http.ResponseWriter, req *http.Request, id string) {
+	// The body is optional; without one the game ends with no winner.
+	request := struct {
+		WinningTeam Team `json:"winning_team"`
+	}{WinningTeam: Neutral}
+	if err := json.NewDecoder(req.Body).Decode(&request); err != nil && err != io.EOF {
+		writeError(rw, http.StatusBadRequest, "bad_request", "Error decoding request: "+err.Error())
+		return
+	}
+	if request.WinningTeam == Black {
+		writeError(rw, http.StatusBadRequest, "bad_request", "Black can't win")
+		return
+	}
+
+	e, ok := s.games.get(id)
+	if !ok {
+		writeError(rw, http.StatusNotFound, "game_not_found", "No such game")
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if err := e.game.End(request.WinningTeam); err != nil {
+		writeError(rw, http.StatusBadRequest, "invalid_action", err.Error())
+		return
+	}
+	s.metrics.gamesCompleted.inc(request.WinningTeam.String())
+	s.gameChanged(e)
+	s.logFor(req).Info("admin ended game", "game_id", id, "winning_team", request.WinningTeam)
+	writeJSON(rw, s.detail(e.game))
+}
+
+func (s *Server) handleAdminCleanup(rw http.ResponseWriter, req *http.Request) {
+	removed := s.cleanupOldGames()
+	s.logFor(req).Info("admin ran cleanup", "removed", removed)
+	writeJSON(rw, struct {
+		Removed int `json:"removed"`
+	}{removed})
+}
+
+// handleAdminExport exports every game that finished at or after from
+// and before to, both RFC 3339 times and both optional, as JSON or,
+// with format=csv, CSV.
+func (s *Server) handleAdminExport(rw http.ResponseWriter, req *http.Request) {
+	format := req.FormValue("format")
+	if format != "" && format != "json" && format != "csv" {
+		writeError(rw, http.StatusBadRequest, "bad_request", "Format must be json or csv")
+		return
+	}
+	var from, to time.Time
+	for _, t := range []struct {
+		name string
+		time *time.Time
+	}{{"from", &from}, {"to", &to}} {
+		v := req.FormValue(t.name)
+		if v == "" {
+			continue
+		}
+		var err error
+		if *t.time, err = time.Parse(time.RFC3339, v); err != nil {
+			writeError(rw, http.StatusBadRequest, "bad_request", "Bad "+t.name+" time, use RFC 3339")
+			return
+		}
+	}
+	records := s.records.between(from, to)
+	writeRecords(rw, format, "games", records, struct {
+		Games []*GameRecord `json:"games"`
+	}{records})
+}
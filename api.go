@@ -0,0 +1,313 @@
+package trapwords
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// apiPrefix is where the current version of the game API lives.
+const apiPrefix = "/api/v1"
+
+// registerAPI adds the game API to mux, along with the older routes it
+// replaces.
+func (s *Server) registerAPI(mux *http.ServeMux) {
+	mux.HandleFunc(apiPrefix+"/", s.handleAPI)
+
+	// Deprecated routes from before /api/v1. They name their game in
+	// the request body rather than the path. Actions added since only
+	// exist under /api/v1.
+	mux.HandleFunc("/stats", s.handleStats)
+	mux.HandleFunc("/game/", s.handleRetrieveGame)
+	actions := s.gameActions()
+	for _, action := range []string{"end-turn", "guess", "next-game"} {
+		mux.Handle("/"+action, legacy(action, actions[action]))
+	}
+}
+
+// handleAPI routes the game API:
+//
+//	GET  /api/v1/openapi.yaml            this API's OpenAPI description
+//	GET  /api/v1/stats                   server statistics
+//	POST /api/v1/games                   create a game
+//	GET  /api/v1/games/<id>              fetch a game
+//	POST /api/v1/games/<id>/<action>     act on a game; see gameActions
+func (s *Server) handleAPI(rw http.ResponseWriter, req *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(req.URL.Path, apiPrefix+"/"), "/"), "/")
+
+	switch {
+	case len(parts) == 1 && parts[0] == "openapi.yaml":
+		if allowAPIMethod(rw, req, "GET") {
+			s.handleOpenAPI(rw, req)
+		}
+	case len(parts) == 1 && parts[0] == "stats":
+		if allowAPIMethod(rw, req, "GET") {
+			s.handleStats(rw, req)
+		}
+	case len(parts) == 1 && parts[0] == "games":
+		if allowAPIMethod(rw, req, "POST") {
+			s.handleCreateGame(rw, req)
+		}
+	case len(parts) == 2 && parts[0] == "games":
+		req.SetPathValue("id", parts[1])
+		if allowAPIMethod(rw, req, "GET") {
+			s.handleGetGame(rw, req)
+		}
+	case len(parts) == 1 && parts[0] == "profiles":
+		if allowAPIMethod(rw, req, "POST") {
+			s.handleCreateProfile(rw, req)
+		}
+	case len(parts) == 2 && parts[0] == "profiles" && parts[1] == "me":
+		if allowAPIMethod(rw, req, "GET", "POST") {
+			s.handleMyProfile(rw, req)
+		}
+	case len(parts) == 2 && parts[0] == "profiles":
+		if allowAPIMethod(rw, req, "GET") {
+			s.handleGetProfile(rw, req, parts[1])
+		}
+	case len(parts) == 1 && parts[0] == "leaderboard":
+		if allowAPIMethod(rw, req, "GET") {
+			s.handleLeaderboard(rw, req, "")
+		}
+	case len(parts) == 3 && parts[0] == "leagues" && parts[2] == "leaderboard":
+		if allowAPIMethod(rw, req, "GET") {
+			s.handleLeaderboard(rw, req, parts[1])
+		}
+	case len(parts) == 3 && parts[0] == "games" && parts[2] == "export":
+		req.SetPathValue("id", parts[1])
+		if allowAPIMethod(rw, req, "GET") {
+			s.handleExport(rw, req)
+		}
+	case len(parts) == 3 && parts[0] == "games" && s.gameActions()[parts[2]] != nil:
+		req.SetPathValue("id", parts[1])
+		if allowAPIMethod(rw, req, "POST") {
+			s.gameActions()[parts[2]](rw, req)
+		}
+	default:
+		writeError(rw, http.StatusNotFound, "not_found", "No such endpoint")
+	}
+}
+
+// allowAPIMethod responds with 405 and returns false unless req uses
+// one of methods.
+func allowAPIMethod(rw http.ResponseWriter, req *http.Request, methods ...string) bool {
+	for _, m := range methods {
+		if req.Method == m {
+			return true
+		}
+	}
+	rw.Header().Set("Allow", strings.Join(methods, ", "))
+	writeError(rw, http.StatusMethodNotAllowed, "method_not_allowed", "Method not allowed")
+	return false
+}
+
+// gameActions returns the handlers for POST /api/v1/games/<id>/<action>
+// by action.
+func (s *Server) gameActions() map[string]http.HandlerFunc {
+	return map[string]http.HandlerFunc{
+		"join":      s.handleJoin,
+		"leave":     s.handleLeave,
+		"team":      s.handleTeam,
+		"end-turn":  s.handleEndTurn,
+		"guess":     s.handleGuess,
+		"next-game": s.handleNextGame,
+		"kick":      s.handleKick,
+		"set-round": s.handleSetRound,
+		"settings":  s.handleSettings,
+	}
+}
+
+// legacy serves an old route that names its game in the JSON body with
+// h, the /api/v1 handler for action.
+func legacy(action string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		gameID := peekGameID(req)
+		req.SetPathValue("id", gameID)
+		rw.Header().Set("Deprecation", "true")
+		rw.Header().Set("Link", fmt.Sprintf(`<%s/games/%s/%s>; rel="successor-version"`, apiPrefix, url.PathEscape(gameID), action))
+		h.ServeHTTP(rw, req)
+	})
+}
+
+// The request and response bodies of the API. They're exported so the
+// client package speaks exactly what the server does.
+
+// GameResponse is a game as one player sees it. Every request that
+// fetches or changes a game gets one back.
+type GameResponse struct {
+	*Game
+	// StateID recreates the game if the server loses it. Like the seed,
+	// only players get it: the words can be worked out from either.
+	StateID string `json:"state_id,omitempty"`
+	// PlayerID and Team are the requesting player's, and Spectator is
+	// set if they're only watching.
+	PlayerID  string `json:"player_id"`
+	Team      Team   `json:"team"`
+	Spectator bool   `json:"spectator,omitempty"`
+	// Players are the players still in the game, in the order they
+	// joined, and Spectators counts the people watching it.
+	Players    []PlayerInfo `json:"players"`
+	Spectators int          `json:"spectators"`
+}
+
+// PlayerInfo describes a player to the other players. Players playing
+// as a profile have its ID and name.
+type PlayerInfo struct {
+	ID        string `json:"id"`
+	Team      Team   `json:"team"`
+	ProfileID string `json:"profile_id,omitempty"`
+	Name      string `json:"name,omitempty"`
+}
+
+type StatsResponse struct {
+	InProgress int `json:"games_in_progress"`
+}
+
+// CreateGameRequest is the body of POST /api/v1/games. A game without
+// an ID gets a made up one, a game with a password is private, and a
+// game with a MatchLength is the first of a match of that many games.
+type CreateGameRequest struct {
+	ID          string `json:"id,omitempty"`
+	WordsLink   string `json:"words_link,omitempty"`
+	Password    string `json:"password,omitempty"`
+	MatchLength int    `json:"match_length,omitempty"`
+}
+
+type JoinRequest struct {
+	Password string `json:"password,omitempty"`
+	// Spectator joins to watch the game rather than play it.
+	Spectator bool `json:"spectator,omitempty"`
+}
+
+type TeamRequest struct {
+	Team Team `json:"team"`
+}
+
+// The requests below may carry the Revision of the game the player last
+// saw, in which case they're refused if the game has changed since.
+// StateID lets the server recreate a game it has lost.
+
+type EndTurnRequest struct {
+	StateID  string `json:"state_id,omitempty"`
+	Revision *int64 `json:"revision,omitempty"`
+}
+
+type GuessRequest struct {
+	StateID  string `json:"state_id,omitempty"`
+	Revision *int64 `json:"revision,omitempty"`
+	Index    int    `json:"index"`
+}
+
+type NextGameRequest struct {
+	Revision *int64 `json:"revision,omitempty"`
+	// SwapTeams moves everyone on red to blue and vice versa.
+	SwapTeams bool `json:"swap_teams,omitempty"`
+}
+
+type SetRoundRequest struct {
+	Revision *int64 `json:"revision,omitempty"`
+	Round    int    `json:"round"`
+}
+
+type KickRequest struct {
+	PlayerID string `json:"player_id"`
+}
+
+// SettingsRequest changes a game's settings. Fields left nil stay as
+// they are; an empty Password makes the game public, and a MatchLength
+// of 0 takes the game out of its match.
+type SettingsRequest struct {
+	Password    *string `json:"password,omitempty"`
+	MatchLength *int    `json:"match_length,omitempty"`
+}
+
+type CreateProfileRequest struct {
+	Name   string `json:"name"`
+	League string `json:"league,omitempty"`
+}
+
+// CreateProfileResponse is a new profile with its device token, which
+// is never shown again.
+type CreateProfileResponse struct {
+	*Profile
+	Token string `json:"token"`
+}
+
+// UpdateProfileRequest changes a profile. Fields left nil stay as they
+// are; an empty League leaves every league.
+type UpdateProfileRequest struct {
+	Name   *string `json:"name,omitempty"`
+	League *string `json:"league,omitempty"`
+}
+
+type LeaderboardResponse struct {
+	League  string             `json:"league,omitempty"`
+	Sort    string             `json:"sort"`
+	Entries []LeaderboardEntry `json:"entries"`
+}
+
+type LeaderboardEntry struct {
+	Rank      int          `json:"rank"`
+	ProfileID string       `json:"profile_id"`
+	Name      string       `json:"name"`
+	League    string       `json:"league,omitempty"`
+	Stats     ProfileStats `json:"stats"`
+}
+
+// ErrorResponse is the body of every error response from the API.
+type ErrorResponse struct {
+	Error APIError `json:"error"`
+}
+
+// APIError describes why a request failed. Code is meant for programs
+// and stays stable; Message is meant for people.
+type APIError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *APIError) Error() string {
+	return e.Message
+}
+
+func writeError(rw http.ResponseWriter, status int, code, message string) {
+	writeJSONStatus(rw, status, ErrorResponse{APIError{Code: code, Message: message}})
+}
+
+// decodeRequest decodes req's JSON body into v. An empty body leaves v
+// as it is. On failure it writes a 400 and returns false.
+func decodeRequest(rw http.ResponseWriter, req *http.Request, v interface{}) bool {
+	if err := json.NewDecoder(req.Body).Decode(v); err != nil && err != io.EOF {
+		writeError(rw, http.StatusBadRequest, "bad_request", "Error decoding request: "+err.Error())
+		return false
+	}
+	return true
+}
+
+// gameActionPath splits an /api/v1/games/<id>/<action> path.
+func gameActionPath(p string) (gameID, action string, ok bool) {
+	rest, ok := strings.CutPrefix(p, apiPrefix+"/games/")
+	if !ok {
+		return "", "", false
+	}
+	parts := strings.Split(strings.Trim(rest, "/"), "/")
+	if len(parts) != 2 {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
+
+// GET /api/v1/openapi.yaml
+func (s *Server) handleOpenAPI(rw http.ResponseWriter, req *http.Request) {
+	spec, err := fs.ReadFile(s.assetFS, "openapi.yaml")
+	if err != nil {
+		writeError(rw, http.StatusInternalServerError, "internal", "Unable to read API spec")
+		return
+	}
+	rw.Header().Set("Content-Type", "application/yaml")
+	rw.Write(spec)
+}
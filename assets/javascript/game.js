@@ -28,8 +28,12 @@ class StatusComponent extends React.Component {
 };
 
 class WordComponent extends React.Component {
-    // Required props: team, blueWord, redWord, phase, cluegiver, guessing
+    // Required props: team, blueWord, redWord, phase, cluegiver, guessing, spectator
     render() {
+        // Spectators only get each word once the turn guessing it is over.
+        if (this.props.spectator) {
+            return <div>You're watching. Each word appears here once its turn is over: <h2>{this.props.blueWord || "?"} / {this.props.redWord || "?"}</h2></div>;
+        }
         if (this.props.team == null) {
             return <p>Choose a team!</p>;
         }
@@ -105,6 +109,26 @@ class TimerComponent extends React.Component {
     }
 };
 
+// MatchComponent shows how a best-of-N match is going.
+class MatchComponent extends React.Component {
+    render() {
+        let m = this.props.match;
+        let result;
+        if (m.winning_team == 'neutral') {
+            result = 'The match is drawn!';
+        } else if (m.winning_team) {
+            result = 'The ' + m.winning_team + ' team wins the match!';
+        } else {
+            result = 'Game ' + (m.games.length + 1) + ' of ' + m.length;
+        }
+        return (
+            <div id="match">
+                Best of {m.length}: <span className="red">Red {m.wins.red}</span> &ndash; <span className="blue">Blue {m.wins.blue}</span>. {result}
+            </div>
+        );
+    }
+};
+
 window.Game = React.createClass({
     propTypes: {
         gameID: React.PropTypes.string,
@@ -143,7 +167,11 @@ window.Game = React.createClass({
             mode: 'game',
             team: null,
             cluegiver: false,
+            spectator: false,
             guessing: false,
+            needsPassword: false,
+            password: '',
+            joinFailed: false,
         };
     },
 
@@ -159,36 +187,103 @@ window.Game = React.createClass({
 
     componentWillMount: function() {
         window.addEventListener("keydown", this.handleKeyDown.bind(this));
+        window.addEventListener("pagehide", this.leave);
         this.refresh();
     },
 
+    // Tell the server we've gone so that, if we're the host, someone
+    // else takes over straight away.
+    leave: function() {
+        if (navigator.sendBeacon) {
+            navigator.sendBeacon(this.gameURL('/leave'));
+        }
+    },
+
     componentWillUnmount: function() {
         window.removeEventListener("keydown", this.handleKeyDown.bind(this));
         this.setState({mounted: false});
     },
 
+    // gameURL returns the API URL for this game, or for an action on it.
+    gameURL: function(action) {
+        return '/api/v1/games/' + encodeURIComponent(this.props.gameID) + (action || '');
+    },
+
     refresh: function() {
         if (!this.state.mounted) {
             return;
         }
+        this.fetchGame();
+        setTimeout(this.refresh, 3000);
+    },
 
-        var refreshURL = '/game/' + this.props.gameID;
+    fetchGame: function() {
+        var refreshURL = this.gameURL();
         if (this.state.game && this.state.game.state_id) {
             refreshURL = refreshURL + "?state_id=" + this.state.game.state_id;
         }
 
         $.get(refreshURL, (data) => {
-            if (this.state.game && data.created_at != this.state.game.created_at) {
-                this.setState({team: null});
+            // Anyone can read a public game, but only players can play
+            // it, so join it the first time we see it.
+            if (!data.player_id && !this.joining) {
+                this.join();
+            }
+            this.gameLoaded(data);
+            this.setState({needsPassword: false});
+        }).fail((xhr) => {
+            // The game is private and we haven't joined it yet.
+            if (xhr.status == 401) {
+                this.setState({needsPassword: true});
             }
-            this.setState({game: data});
         });
-        setTimeout(this.refresh, 3000);
+    },
+
+    // Teams and cluegivers are tracked by the server, which only lets
+    // players act when it's their turn.
+    gameLoaded: function(g) {
+        this.setState({
+            game: g,
+            team: g.team == 'neutral' ? null : g.team,
+            cluegiver: g.cluegiver_id == g.player_id,
+            spectator: !!g.spectator,
+        });
+    },
+
+    actionFailed: function(xhr) {
+        var body = xhr.responseJSON;
+        this.setState({actionError: body && body.error ? body.error.message : xhr.statusText});
+        // Someone else changed the game first. Catch up so the player
+        // can decide again with the current state in front of them.
+        if (xhr.status == 409) {
+            this.fetchGame();
+        }
+    },
+
+    passwordChange: function(e) {
+        this.setState({password: e.target.value});
+    },
+
+    join: function(e) {
+        if (e != null) e.preventDefault();
+        this.joining = true;
+        $.post(this.gameURL('/join'), JSON.stringify({
+            password: this.state.password,
+        })).done((g) => {
+            this.gameLoaded(g);
+            this.setState({needsPassword: false, password: '', joinFailed: false});
+        }).fail(() => {
+            this.setState({joinFailed: true});
+        }).always(() => {
+            this.joining = false;
+        });
     },
 
     setRole: function(e, role) {
         e.preventDefault();
-        this.setState({team: role});
+        $.post(this.gameURL('/team'), JSON.stringify({
+            team: role,
+        }), this.gameLoaded);
     },
 
     currentPhase: function() {
@@ -223,30 +318,30 @@ window.Game = React.createClass({
     },
 
     nextPhase: function() {
-        let r = this.state.game.round;
-        if (r == 1 || r == 3 || r == 6 || r == 8) {
-            this.setState({cluegiver: true});
-        }
-        if (r == 0 || r == 5) {
-            this.setState({cluegiver: false});
-        }
-        $.post('/end-turn', JSON.stringify({
-            game_id: this.state.game.id,
+        this.setState({actionError: null});
+        $.post(this.gameURL('/end-turn'), JSON.stringify({
             state_id: this.state.game.state_id,
-        }), (g) => { this.setState({game: g}); });
+            revision: this.state.game.revision,
+        }), this.gameLoaded).fail(this.actionFailed);
     },
 
-    trapwordsChosen: function() {
-        $.post('/trapwords-chosen', JSON.stringify({
-            game_id: this.state.game.id,
-            state_id: this.state.game.state_id,
-        }), (g) => { this.setState({game: g}); });
+    isHost: function() {
+        return this.state.game.host_id == this.state.game.player_id;
+    },
+
+    kick: function(e, playerID) {
+        e.preventDefault();
+        $.post(this.gameURL('/kick'), JSON.stringify({
+            player_id: playerID,
+        }), this.gameLoaded);
     },
 
-    nextGame: function(e) {
+    nextGame: function(e, swapTeams) {
         e.preventDefault();
-        $.post('/next-game', JSON.stringify({game_id: this.state.game.id}),
-              (g) => { this.setState({game: g, cluegiver: false}) });
+        $.post(this.gameURL('/next-game'), JSON.stringify({
+            revision: this.state.game.revision,
+            swap_teams: swapTeams,
+        }), this.gameLoaded).fail(this.actionFailed);
     },
 
     toggleSettings: function(e) {
@@ -267,6 +362,18 @@ window.Game = React.createClass({
     },
 
     render: function() {
+        if (this.state.needsPassword) {
+            return (
+                <form id="join-game" onSubmit={this.join}>
+                    <p className="intro">This game is private. Enter its password to join.</p>
+                    <input type="password" id="game-password" autoFocus
+                        onChange={this.passwordChange} value={this.state.password} />
+                    <button type="submit">Join</button>
+                    {this.state.joinFailed ? <p className="message bad">Wrong password, try again?</p> : null}
+                </form>
+            );
+        }
+
         if (!this.state.game) {
             return (<p className="loading">Loading&hellip;</p>);
         }
@@ -327,7 +434,9 @@ window.Game = React.createClass({
             <div id="game-view" className={(this.state.cluegiver ? "cluegiver" : "player") + this.extraClasses()}>
                 <div id="share">
                   Send this link to friends: <a className="url" href={window.location.href}>{window.location.href}</a>
+                  {this.state.game.spectators > 0 ? <span id="spectators">{this.state.game.spectators} watching</span> : null}
                 </div>
+                {this.state.game.match ? <MatchComponent match={this.state.game.match} /> : null}
                 <div id="status-line" className={this.currentPhase()}>
                     <div id="status" className="status-text">
                         <StatusComponent phase={this.currentPhase()} guessing={this.guessing()}/>
@@ -335,8 +444,9 @@ window.Game = React.createClass({
                 </div>
                 <div id="button-line">
                     <div id="remaining"><TimerComponent guessing={this.guessing()} end={this.state.game.guessEnd}/></div>
-                    {nextPhaseButton}
+                    {this.state.spectator ? null : nextPhaseButton}
                     <div className="clear"></div>
+                    {this.state.actionError ? <p className="message bad">{this.state.actionError}</p> : null}
                 </div>
                 <div className="board">
                   <WordComponent
@@ -346,6 +456,7 @@ window.Game = React.createClass({
                       phase={this.currentPhase()}
                       cluegiver={this.state.cluegiver}
                       guessing={this.guessing()}
+                      spectator={this.state.spectator}
                   />
                 </div>
                 <form id="mode-toggle" className={this.state.cluegiver ? "cluegiver-selected" : "player-selected"}>
@@ -355,10 +466,26 @@ window.Game = React.createClass({
                         <path d="M22.3344 4.86447L24.31 8.23766C21.9171 9.80387 21.1402 12.9586 22.5981 15.4479C23.038 16.1989 23.6332 16.8067 24.3204 17.2543L22.2714 20.7527C20.6682 19.9354 18.6888 19.9151 17.0088 20.8712C15.3443 21.8185 14.3731 23.4973 14.2734 25.2596H10.3693C10.3241 24.4368 10.087 23.612 9.64099 22.8504C8.16283 20.3266 4.93593 19.4239 2.34593 20.7661L0.342913 17.3461C2.85907 15.8175 3.70246 12.5796 2.21287 10.0362C1.74415 9.23595 1.09909 8.59835 0.354399 8.14386L2.34677 4.74208C3.95677 5.5788 5.95446 5.60726 7.64791 4.64346C9.31398 3.69524 10.2854 2.0141 10.3836 0.25H14.267C14.2917 1.11932 14.5297 1.99505 15.0012 2.80013C16.4866 5.33635 19.738 6.23549 22.3344 4.86447ZM15.0038 17.3703C17.6265 15.8776 18.5279 12.5685 17.0114 9.97937C15.4963 7.39236 12.1437 6.50866 9.52304 8.00013C6.90036 9.4928 5.99896 12.8019 7.5154 15.391C9.03058 17.978 12.3832 18.8617 15.0038 17.3703Z" transform="translate(12.7548) rotate(30)" fill="#EEE" stroke="#BBB" stroke-width="0.5"/>
                       </svg>
                     </button>
-                    <button onClick={(e) => this.setRole(e, 'blue')} className="blue">Blue Team</button>
-                    <button onClick={(e) => this.setRole(e, 'red')} className="red">Red Team</button>
-                    <button onClick={(e) => this.nextGame(e)} id="next-game-btn">Next game</button>
+                    {this.state.spectator ? null : <button onClick={(e) => this.setRole(e, 'blue')} className="blue">Blue Team</button>}
+                    {this.state.spectator ? null : <button onClick={(e) => this.setRole(e, 'red')} className="red">Red Team</button>}
+                    {this.isHost() ? <button onClick={(e) => this.nextGame(e, false)} id="next-game-btn">Next game</button> : null}
+                    {this.isHost() ? <button onClick={(e) => this.nextGame(e, true)} id="swap-sides-btn" title="Start the next game with everyone on the other team">Swap sides</button> : null}
                 </form>
+                {this.isHost() ? (
+                    <div id="host-controls">
+                        <p>You're the host. Players in this game:</p>
+                        {this.state.game.private ? null : <p>Anyone can join a public game, so kicked players can come back as someone new. Set a password to keep them out.</p>}
+                        <ul>
+                            {this.state.game.players.map((p, i) => (
+                            <li key={p.id}>
+                                {p.name || "Player " + (i + 1)} ({p.team}){p.id == this.state.game.player_id ? " (you)" : (
+                                    <button onClick={(e) => this.kick(e, p.id)} className="kick">Kick</button>
+                                )}
+                            </li>
+                            ))}
+                        </ul>
+                    </div>
+                ) : null}
             </div>
         );
     }
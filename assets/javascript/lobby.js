@@ -25,9 +25,41 @@ window.Lobby = React.createClass({
             newGameName: this.props.defaultGameID,
             selectedGame: null,
             newGameWordsLinkGood: null,
+            profile: null,
+            playerName: '',
+            matchLength: '0',
         };
     },
 
+    componentDidMount: function() {
+        // Returning players have a profile, which remembers their name.
+        $.get('/api/v1/profiles/me', (profile) => {
+            this.setState({profile: profile, playerName: profile.name});
+        });
+    },
+
+    matchLengthChange: function(e) {
+        this.setState({matchLength: e.target.value});
+    },
+
+    playerNameChange: function(e) {
+        this.setState({playerName: e.target.value});
+    },
+
+    // saveProfile creates or renames the player's profile if they've
+    // given a name, then calls done either way.
+    saveProfile: function(done) {
+        let name = this.state.playerName.trim();
+        if (!name || (this.state.profile && this.state.profile.name == name)) {
+            done();
+            return;
+        }
+        let url = this.state.profile ? '/api/v1/profiles/me' : '/api/v1/profiles';
+        $.post(url, JSON.stringify({name: name})).done((profile) => {
+            this.setState({profile: profile});
+        }).always(done);
+    },
+
     newGameTextChange: function(e) {
         this.setState({newGameName: e.target.value});
     },
@@ -36,33 +68,69 @@ window.Lobby = React.createClass({
         this.setState({newGameWordsLink: e.target.value});
     },
 
+    newGamePasswordChange: function(e) {
+        this.setState({newGamePassword: e.target.value});
+    },
+
+    gameJoined: function(game) {
+        this.setState({
+            newGameName: '',
+            selectedGame: game,
+            newGameWordsLinkGood: true,
+            newGameWordsLink: '',
+            newGamePassword: '',
+            joinFailed: false,
+        });
+
+        if (this.props.gameSelected) {
+            this.props.gameSelected(game);
+        }
+    },
+
     handleNewGame: function(e) {
         e.preventDefault();
         if (!this.state.newGameName) {
             return;
         }
 
-        this.setState({newGameWordsLinkGood: null});
-
-        $.post(
-            '/game/'+this.state.newGameName,
-            {"newGameWordsLink": this.state.newGameWordsLink},
-        ).done(function(game) {
-            this.setState({
-                newGameName: '',
-                selectedGame: game,
-                newGameWordsLinkGood: true,
-                newGameWordsLink: '',
-            });
-
-            if (this.props.gameSelected) {
-                this.props.gameSelected(game);
+        this.setState({newGameWordsLinkGood: null, joinFailed: false});
+        this.saveProfile(this.createGame);
+    },
+
+    createGame: function() {
+        $.post('/api/v1/games', JSON.stringify({
+            id: this.state.newGameName,
+            words_link: this.state.newGameWordsLink || '',
+            password: this.state.newGamePassword || '',
+            match_length: parseInt(this.state.matchLength, 10) || 0,
+        })).done(this.gameJoined).fail(function(xhr) {
+            // The game already exists, so join it instead.
+            if (xhr.status == 409) {
+                this.joinGame();
+                return;
             }
-        }.bind(this)).fail(function() {
             this.setState({newGameWordsLinkGood: false});
         }.bind(this));
     },
 
+    joinGame: function(spectator) {
+        $.post('/api/v1/games/' + encodeURIComponent(this.state.newGameName) + '/join', JSON.stringify({
+            password: this.state.newGamePassword || '',
+            spectator: spectator === true,
+        })).done(this.gameJoined).fail(function() {
+            this.setState({joinFailed: true});
+        }.bind(this));
+    },
+
+    handleWatch: function(e) {
+        e.preventDefault();
+        if (!this.state.newGameName) {
+            return;
+        }
+        this.setState({joinFailed: false});
+        this.joinGame(true);
+    },
+
     render: function() {
         return (
             <div id="lobby">
@@ -76,14 +144,35 @@ window.Lobby = React.createClass({
                         <input type="text" id="game-name" autoFocus
                             onChange={this.newGameTextChange} value={this.state.newGameName} />
                         <button onClick={this.handleNewGame}>Go</button>
+                        <button onClick={this.handleWatch} id="watch-game" title="Watch an existing game without playing">Watch</button>
                         <p className ="intro">
                             You can use your own words using the field below. See <a href="https://github.com/banool/trapwords#loading-up-words">the GitHub readme</a> for information about valid link options.
                         </p>
                         <input className="full" type="text" id="user-words" placeholder="Link to text file of words"
                             onChange={this.newGameWordsLinkChange} value={this.state.newGameWordsLink} />
+                        <p className="intro">
+                            To make a new game private, give it a password. Anyone joining it will need the password too.
+                        </p>
+                        <input className="full" type="password" id="game-password" placeholder="Password (optional)"
+                            onChange={this.newGamePasswordChange} value={this.state.newGamePassword} />
+                        <p className="intro">
+                            Play a single game, or a match where the team that wins the most games wins.
+                        </p>
+                        <select id="match-length" onChange={this.matchLengthChange} value={this.state.matchLength}>
+                            <option value="0">Single game</option>
+                            <option value="3">Best of 3</option>
+                            <option value="5">Best of 5</option>
+                            <option value="7">Best of 7</option>
+                        </select>
+                        <p className="intro">
+                            Give yourself a name to keep track of your wins across games. It's remembered on this device.
+                        </p>
+                        <input className="full" type="text" id="player-name" placeholder="Your name (optional)" maxLength="32"
+                            onChange={this.playerNameChange} value={this.state.playerName} />
                     </form>
                     <p>If you're joining a game that already exists, this field will be ignored. Have fun!!!</p>
                     <WordLinkStatusComponent good={this.state.newGameWordsLinkGood} />
+                    {this.state.joinFailed ? <p className="message bad">Couldn't join that game. Does it exist, and if it's private, was the password right?</p> : null}
                 </div>
             </div>
         );
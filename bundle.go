@@ -0,0 +1,192 @@
+package trapwords
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"html/template"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jbowens/assets"
+	"github.com/jbowens/dictionary"
+)
+
+// embeddedAssets is a copy of the assets directory compiled into the
+// binary, so a production deployment is a single file.
+//
+//go:embed assets
+var embeddedAssets embed.FS
+
+// buildTime stands in for the modification time of embedded files,
+// which embed.FS doesn't record.
+var buildTime = time.Now()
+
+// assetFS returns the filesystem the server reads its assets from:
+// AssetRoot on disk in development mode, the embedded copy otherwise.
+func (c Config) assetFS() (fs.FS, error) {
+	if c.DevAssets {
+		return os.DirFS(c.AssetRoot), nil
+	}
+	return fs.Sub(embeddedAssets, "assets")
+}
+
+// wordPackFS returns the filesystem word lists are read from.
+func (c Config) wordPackFS() (fs.FS, error) {
+	if c.WordPackDir != "" {
+		return os.DirFS(c.WordPackDir), nil
+	}
+	return c.assetFS()
+}
+
+// loadDictionary reads a newline separated word list, like
+// dictionary.Load but from any filesystem.
+func loadDictionary(fsys fs.FS, name string) (dictionary.Interface, error) {
+	b, err := fs.ReadFile(fsys, name)
+	if err != nil {
+		return nil, err
+	}
+	return dictionary.WithWords(strings.Split(strings.TrimSpace(string(b)), "\n")...), nil
+}
+
+// loadAssets bundles the scripts, stylesheets and images in assetFS and
+// parses the index page template.
+func (s *Server) loadAssets(assetFS fs.FS) error {
+	var err error
+	s.jslib, err = s.Config.newBundle(assetFS, "jslib")
+	if err != nil {
+		return err
+	}
+	s.js, err = s.Config.newBundle(assetFS, "javascript")
+	if err != nil {
+		return err
+	}
+	s.css, err = s.Config.newBundle(assetFS, "stylesheets")
+	if err != nil {
+		return err
+	}
+	s.other, err = s.Config.newBundle(assetFS, "other")
+	if err != nil {
+		return err
+	}
+	s.assetFS = assetFS
+	s.tpl, err = s.template()
+	return err
+}
+
+// template returns the index page template. In development mode it's
+// re-read on every call so edits show up on refresh.
+func (s *Server) template() (*template.Template, error) {
+	if s.tpl != nil && !s.Config.DevAssets {
+		return s.tpl, nil
+	}
+	b, err := fs.ReadFile(s.assetFS, "templates/index.html")
+	if err != nil {
+		return nil, err
+	}
+	return template.New("index").Funcs(template.FuncMap{
+		"jslib": func(name string) string { return fingerprinted(s.jslib, name) },
+	}).Parse(string(b))
+}
+
+// newBundle serves the files in dir of fsys. In development mode the
+// files are re-read on every request and never cached; otherwise they
+// are served from memory under content-hash fingerprinted names.
+func (c Config) newBundle(fsys fs.FS, dir string) (assets.Bundle, error) {
+	if c.DevAssets {
+		return assets.Development(c.assetPath(dir))
+	}
+	sub, err := fs.Sub(fsys, dir)
+	if err != nil {
+		return nil, err
+	}
+	return newEmbeddedBundle(sub)
+}
+
+// fingerprinted returns the path b serves the file name under.
+func fingerprinted(b assets.Bundle, name string) string {
+	if eb, ok := b.(*embeddedBundle); ok {
+		if f, ok := eb.byName[name]; ok {
+			return f.fingerprinted
+		}
+	}
+	return name
+}
+
+type embeddedFile struct {
+	name          string
+	fingerprinted string
+	etag          string
+	data          []byte
+}
+
+// embeddedBundle is an assets.Bundle holding every file in memory.
+type embeddedBundle struct {
+	byName        map[string]*embeddedFile
+	byFingerprint map[string]*embeddedFile
+	paths         []string
+}
+
+func newEmbeddedBundle(fsys fs.FS) (*embeddedBundle, error) {
+	b := &embeddedBundle{
+		byName:        make(map[string]*embeddedFile),
+		byFingerprint: make(map[string]*embeddedFile),
+	}
+	err := fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		data, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(data)
+		hash := hex.EncodeToString(sum[:4])
+		ext := path.Ext(name)
+		f := &embeddedFile{
+			name:          name,
+			fingerprinted: strings.TrimSuffix(name, ext) + "-" + hash + ext,
+			etag:          `"` + hex.EncodeToString(sum[:]) + `"`,
+			data:          data,
+		}
+		b.byName[f.name] = f
+		b.byFingerprint[f.fingerprinted] = f
+		b.paths = append(b.paths, f.fingerprinted)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(b.paths)
+	return b, nil
+}
+
+// RelativePaths implements assets.Bundle.
+func (b *embeddedBundle) RelativePaths() []string {
+	return b.paths
+}
+
+// ServeHTTP implements http.Handler. Fingerprinted paths change
+// whenever the content does, so they may be cached forever. Plain
+// names are still served for anything that links to them directly,
+// but only cached briefly.
+func (b *embeddedBundle) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	name := strings.TrimPrefix(req.URL.Path, "/")
+	f, ok := b.byFingerprint[name]
+	if ok {
+		rw.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	} else if f, ok = b.byName[name]; ok {
+		rw.Header().Set("Cache-Control", "public, max-age=300")
+	} else {
+		http.NotFound(rw, req)
+		return
+	}
+	rw.Header().Set("ETag", f.etag)
+	http.ServeContent(rw, req, f.name, buildTime, bytes.NewReader(f.data))
+}
@@ -0,0 +1,336 @@
+// Package client talks to a Trapwords server's game API, for bots and
+// integration tests. It uses the same request and response types as
+// the server.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/banool/trapwords"
+)
+
+// Client is one player. The server identifies players by a session
+// cookie per game, which the client keeps in its cookie jar; use one
+// Client per player. A client must create or join a game before it
+// can act on it.
+type Client struct {
+	baseURL      string
+	http         *http.Client
+	profileToken string
+}
+
+// New returns a client for the server at baseURL, like
+// "https://trapwords.example.com".
+func New(baseURL string) *Client {
+	jar, _ := cookiejar.New(nil)
+	return NewWithHTTPClient(baseURL, &http.Client{Jar: jar, Timeout: 30 * time.Second})
+}
+
+// NewWithHTTPClient returns a client that makes its requests with hc,
+// which needs a cookie jar for the client to keep its sessions.
+func NewWithHTTPClient(baseURL string, hc *http.Client) *Client {
+	return &Client{baseURL: strings.TrimRight(baseURL, "/"), http: hc}
+}
+
+// Error is returned when the server refuses a request.
+type Error struct {
+	StatusCode int
+	trapwords.APIError
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%d %s: %s", e.StatusCode, e.Code, e.Message)
+}
+
+// ErrorCode returns the API error code of err, or "" if err didn't
+// come from the server.
+func ErrorCode(err error) string {
+	if e, ok := err.(*Error); ok {
+		return e.Code
+	}
+	return ""
+}
+
+// Revision returns a pointer to g's revision, for requests that should
+// be refused if the game has changed since g.
+func Revision(g *trapwords.GameResponse) *int64 {
+	r := g.Revision
+	return &r
+}
+
+func (c *Client) do(ctx context.Context, method, path string, body, resp interface{}) error {
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+"/api/v1"+path, r)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.profileToken != "" {
+		req.Header.Set("Authorization", "Bearer "+c.profileToken)
+	}
+	res, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode >= 400 {
+		apiErr := &Error{StatusCode: res.StatusCode}
+		var errResp trapwords.ErrorResponse
+		if json.NewDecoder(res.Body).Decode(&errResp) == nil {
+			apiErr.APIError = errResp.Error
+		} else {
+			apiErr.Message = res.Status
+		}
+		return apiErr
+	}
+	if resp == nil {
+		return nil
+	}
+	return json.NewDecoder(res.Body).Decode(resp)
+}
+
+func gamePath(gameID, action string) string {
+	p := "/games/" + url.PathEscape(gameID)
+	if action != "" {
+		p += "/" + action
+	}
+	return p
+}
+
+func (c *Client) game(ctx context.Context, method, gameID, action string, body interface{}) (*trapwords.GameResponse, error) {
+	var g trapwords.GameResponse
+	if err := c.do(ctx, method, gamePath(gameID, action), body, &g); err != nil {
+		return nil, err
+	}
+	return &g, nil
+}
+
+// CreateGame creates a game, making this client its host. It fails with
+// the code "game_exists" if there's already a game with that ID.
+func (c *Client) CreateGame(ctx context.Context, req trapwords.CreateGameRequest) (*trapwords.GameResponse, error) {
+	var g trapwords.GameResponse
+	if err := c.do(ctx, "POST", "/games", req, &g); err != nil {
+		return nil, err
+	}
+	return &g, nil
+}
+
+// JoinGame joins a game. The password is only needed for private games.
+func (c *Client) JoinGame(ctx context.Context, gameID, password string) (*trapwords.GameResponse, error) {
+	return c.game(ctx, "POST", gameID, "join", trapwords.JoinRequest{Password: password})
+}
+
+// Spectate joins a game to watch it. Spectators can't act on the game,
+// and only see each word once the turn guessing it is over.
+func (c *Client) Spectate(ctx context.Context, gameID, password string) (*trapwords.GameResponse, error) {
+	return c.game(ctx, "POST", gameID, "join", trapwords.JoinRequest{Password: password, Spectator: true})
+}
+
+// Game fetches a game. Players who stop fetching it for a while are
+// considered to have left.
+func (c *Client) Game(ctx context.Context, gameID string) (*trapwords.GameResponse, error) {
+	return c.game(ctx, "GET", gameID, "", nil)
+}
+
+// Leave leaves a game.
+func (c *Client) Leave(ctx context.Context, gameID string) error {
+	return c.do(ctx, "POST", gamePath(gameID, "leave"), nil, nil)
+}
+
+// SetTeam puts the player on team, red or blue.
+func (c *Client) SetTeam(ctx context.Context, gameID string, team trapwords.Team) (*trapwords.GameResponse, error) {
+	return c.game(ctx, "POST", gameID, "team", trapwords.TeamRequest{Team: team})
+}
+
+// EndTurn moves the game on to its next round.
+func (c *Client) EndTurn(ctx context.Context, gameID string, req trapwords.EndTurnRequest) (*trapwords.GameResponse, error) {
+	return c.game(ctx, "POST", gameID, "end-turn", req)
+}
+
+// SubmitTrapwords tells the server the trapwords for g's round have
+// been chosen. Players pick trapwords out loud, so all the server
+// records is that the trapwords phase is over, which moves the game on
+// like EndTurn.
+func (c *Client) SubmitTrapwords(ctx context.Context, g *trapwords.GameResponse) (*trapwords.GameResponse, error) {
+	if g.Phase() != trapwords.PhaseTrapwords {
+		return nil, fmt.Errorf("game %s is in the %s phase, not choosing trapwords", g.ID, g.Phase())
+	}
+	return c.EndTurn(ctx, g.ID, trapwords.EndTurnRequest{StateID: g.StateID, Revision: Revision(g)})
+}
+
+// Guess reveals a cell.
+func (c *Client) Guess(ctx context.Context, gameID string, req trapwords.GuessRequest) (*trapwords.GameResponse, error) {
+	return c.game(ctx, "POST", gameID, "guess", req)
+}
+
+// NextGame starts the next game in the same room, keeping its players
+// and settings. Only the host may.
+func (c *Client) NextGame(ctx context.Context, gameID string, req trapwords.NextGameRequest) (*trapwords.GameResponse, error) {
+	return c.game(ctx, "POST", gameID, "next-game", req)
+}
+
+// Kick removes a player from the game. Only the host may.
+func (c *Client) Kick(ctx context.Context, gameID, playerID string) (*trapwords.GameResponse, error) {
+	return c.game(ctx, "POST", gameID, "kick", trapwords.KickRequest{PlayerID: playerID})
+}
+
+// SetRound jumps the game to a round. Only the host may.
+func (c *Client) SetRound(ctx context.Context, gameID string, req trapwords.SetRoundRequest) (*trapwords.GameResponse, error) {
+	return c.game(ctx, "POST", gameID, "set-round", req)
+}
+
+// UpdateSettings changes a game's settings. Only the host may.
+func (c *Client) UpdateSettings(ctx context.Context, gameID string, req trapwords.SettingsRequest) (*trapwords.GameResponse, error) {
+	return c.game(ctx, "POST", gameID, "settings", req)
+}
+
+// Export returns the record of the game if it's finished, or of the
+// last game with its ID to finish.
+func (c *Client) Export(ctx context.Context, gameID string) (*trapwords.GameRecord, error) {
+	var record trapwords.GameRecord
+	if err := c.do(ctx, "GET", gamePath(gameID, "export"), nil, &record); err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+// Stats fetches the server's statistics.
+func (c *Client) Stats(ctx context.Context) (*trapwords.StatsResponse, error) {
+	var stats trapwords.StatsResponse
+	if err := c.do(ctx, "GET", "/stats", nil, &stats); err != nil {
+		return nil, err
+	}
+	return &stats, nil
+}
+
+// CreateProfile creates a profile and plays as it from then on. Keep
+// the token in the response to play as the profile again later, with
+// UseProfile.
+func (c *Client) CreateProfile(ctx context.Context, req trapwords.CreateProfileRequest) (*trapwords.CreateProfileResponse, error) {
+	var prof trapwords.CreateProfileResponse
+	if err := c.do(ctx, "POST", "/profiles", req, &prof); err != nil {
+		return nil, err
+	}
+	c.profileToken = prof.Token
+	return &prof, nil
+}
+
+// UseProfile plays as the profile whose device token is token.
+func (c *Client) UseProfile(token string) {
+	c.profileToken = token
+}
+
+// MyProfile returns the profile the client is playing as. It fails
+// with the code "no_profile" if there isn't one.
+func (c *Client) MyProfile(ctx context.Context) (*trapwords.Profile, error) {
+	var prof trapwords.Profile
+	if err := c.do(ctx, "GET", "/profiles/me", nil, &prof); err != nil {
+		return nil, err
+	}
+	return &prof, nil
+}
+
+// UpdateProfile renames the client's profile or moves it to another
+// league.
+func (c *Client) UpdateProfile(ctx context.Context, req trapwords.UpdateProfileRequest) (*trapwords.Profile, error) {
+	var prof trapwords.Profile
+	if err := c.do(ctx, "POST", "/profiles/me", req, &prof); err != nil {
+		return nil, err
+	}
+	return &prof, nil
+}
+
+// Profile returns anyone's profile.
+func (c *Client) Profile(ctx context.Context, profileID string) (*trapwords.Profile, error) {
+	var prof trapwords.Profile
+	if err := c.do(ctx, "GET", "/profiles/"+url.PathEscape(profileID), nil, &prof); err != nil {
+		return nil, err
+	}
+	return &prof, nil
+}
+
+// Leaderboard ranks the profiles in league, or everyone's if league is
+// empty, by sort: "wins", "games", "words_guessed" or "win_rate".
+func (c *Client) Leaderboard(ctx context.Context, league, sort string) (*trapwords.LeaderboardResponse, error) {
+	p := "/leaderboard"
+	if league != "" {
+		p = "/leagues/" + url.PathEscape(league) + "/leaderboard"
+	}
+	if sort != "" {
+		p += "?sort=" + url.QueryEscape(sort)
+	}
+	var board trapwords.LeaderboardResponse
+	if err := c.do(ctx, "GET", p, nil, &board); err != nil {
+		return nil, err
+	}
+	return &board, nil
+}
+
+// Update is sent by Subscribe: either the game after it changed, or an
+// error fetching it.
+type Update struct {
+	Game *trapwords.GameResponse
+	Err  error
+}
+
+// Subscribe polls a game every interval, like the web client does, and
+// sends it on the returned channel each time it changes. That includes
+// players coming, going and changing teams, which don't all change the
+// game's revision. It also sends errors, but carries on polling until
+// ctx is done, then closes the channel. Polling keeps the player in the
+// game.
+func (c *Client) Subscribe(ctx context.Context, gameID string, interval time.Duration) <-chan Update {
+	updates := make(chan Update)
+	go func() {
+		defer close(updates)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		var last []byte
+		for {
+			g, err := c.Game(ctx, gameID)
+			if ctx.Err() != nil {
+				return
+			}
+			var u *Update
+			if err != nil {
+				u = &Update{Err: err}
+			} else if b, _ := json.Marshal(g); !bytes.Equal(b, last) {
+				last = b
+				u = &Update{Game: g}
+			}
+			if u != nil {
+				select {
+				case updates <- *u:
+				case <-ctx.Done():
+					return
+				}
+			}
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return updates
+}
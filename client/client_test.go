@@ -0,0 +1,100 @@
+package client
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/banool/trapwords"
+)
+
+func newTestServer(t *testing.T) *httptest.Server {
+	s := &trapwords.Server{
+		Config: trapwords.DefaultConfig(),
+		Logger: slog.New(slog.NewTextHandler(io.Discard, nil)),
+	}
+	if err := s.Init(); err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(s.Server.Handler)
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+// TestPlay plays the start of a game through the client against a real
+// server, then watches it with Subscribe.
+func TestPlay(t *testing.T) {
+	ts := newTestServer(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	host, guest, other := New(ts.URL), New(ts.URL), New(ts.URL)
+
+	must := func(g *trapwords.GameResponse, err error) *trapwords.GameResponse {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return g
+	}
+	must(host.CreateGame(ctx, trapwords.CreateGameRequest{ID: "g"}))
+	if _, err := guest.SetTeam(ctx, "g", trapwords.Blue); ErrorCode(err) != "not_joined" {
+		t.Fatalf("choosing a team before joining: %v, want not_joined", err)
+	}
+	must(guest.JoinGame(ctx, "g", ""))
+	must(other.JoinGame(ctx, "g", ""))
+	must(host.SetTeam(ctx, "g", trapwords.Red))
+	must(guest.SetTeam(ctx, "g", trapwords.Blue))
+	must(other.SetTeam(ctx, "g", trapwords.Blue))
+
+	// Anyone on a team ends the trapwords phase, and whoever ends blue's
+	// ready phase gives blue's clues, leaving the other to guess.
+	g := must(host.EndTurn(ctx, "g", trapwords.EndTurnRequest{}))
+	g = must(guest.EndTurn(ctx, "g", trapwords.EndTurnRequest{Revision: Revision(g)}))
+	if g.Phase() != trapwords.PhaseBlueGuessing {
+		t.Fatalf("after both ready turns the game is in the %s phase, want blue guessing", g.Phase())
+	}
+	blue := -1
+	for i, team := range g.Layout {
+		if team == trapwords.Blue {
+			blue = i
+			break
+		}
+	}
+	g = must(other.Guess(ctx, "g", trapwords.GuessRequest{Index: blue, Revision: Revision(g)}))
+	if !g.Revealed[blue] {
+		t.Fatalf("guessed cell %d but it wasn't revealed", blue)
+	}
+
+	updates := host.Subscribe(ctx, "g", 10*time.Millisecond)
+	next := func() *trapwords.GameResponse {
+		t.Helper()
+		select {
+		case u := <-updates:
+			if u.Err != nil {
+				t.Fatal(u.Err)
+			}
+			return u.Game
+		case <-ctx.Done():
+			t.Fatal("timed out waiting for an update")
+			return nil
+		}
+	}
+	if g := next(); !g.Revealed[blue] || len(g.Players) != 3 {
+		t.Fatalf("first update has %d players and cell %d revealed: %v, want the game as it stands", len(g.Players), blue, g.Revealed[blue])
+	}
+
+	// Joining doesn't change the game's revision, but subscribers still
+	// hear about it.
+	late := New(ts.URL)
+	must(late.JoinGame(ctx, "g", ""))
+	if g := next(); len(g.Players) != 4 {
+		t.Errorf("after someone joined the update has %d players, want 4", len(g.Players))
+	}
+	must(late.SetTeam(ctx, "g", trapwords.Red))
+	if g := next(); g.Players[3].Team != trapwords.Red {
+		t.Errorf("after the newcomer chose red, they're on %s", g.Players[3].Team)
+	}
+}
@@ -0,0 +1,60 @@
+package trapwords
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Clock tells the time. The server and its games use the system clock
+// unless they're given another, as tests and the simulator do to
+// control time.
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+func (s *Server) clock() Clock {
+	if s.Clock == nil {
+		return systemClock{}
+	}
+	return s.Clock
+}
+
+func (s *Server) now() time.Time {
+	return s.clock().Now()
+}
+
+// random returns the server's source of randomness for game seeds and
+// made up game IDs, which is safe to share between requests.
+func (s *Server) random() *rand.Rand {
+	s.rndOnce.Do(func() {
+		src := s.Rand
+		if src == nil {
+			src = rand.NewSource(time.Now().UnixNano())
+		}
+		s.rnd = rand.New(&lockedSource{src: src})
+	})
+	return s.rnd
+}
+
+// lockedSource makes a rand.Source safe for concurrent use.
+type lockedSource struct {
+	mu  sync.Mutex
+	src rand.Source
+}
+
+func (s *lockedSource) Int63() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.src.Int63()
+}
+
+func (s *lockedSource) Seed(seed int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.src.Seed(seed)
+}
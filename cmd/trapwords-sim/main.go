@@ -0,0 +1,53 @@
+// Command trapwords-sim plays games with bots for as long as it's told
+// to, stopping at the first game that breaks an invariant. Every game
+// is seeded, so a failure can be replayed with -seed and -games 1.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/banool/trapwords/simulation"
+)
+
+func main() {
+	var (
+		seed     = flag.Int64("seed", 1, "seed of the first game; each game after uses the next")
+		games    = flag.Int("games", 0, "number of games to play, or 0 to play until -duration is up")
+		duration = flag.Duration("duration", time.Minute, "how long to play for if -games is 0")
+		players  = flag.Int("players", 4, "players per game, at least 2")
+		mistakes = flag.Float64("mistakes", 0.1, "how often bots make a random move instead of a sensible one, from 0 to 1")
+	)
+	flag.Parse()
+	if *players < 2 {
+		fmt.Fprintf(os.Stderr, "-players must be at least 2, one for each team\n")
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	deadline := time.Now().Add(*duration)
+	var played, finished, steps, refused int
+	for s := *seed; ; s++ {
+		if *games > 0 && played == *games || *games == 0 && time.Now().After(deadline) {
+			break
+		}
+		cfg := simulation.DefaultConfig(s)
+		cfg.Players = *players
+		cfg.Bot = func(int) simulation.Bot { return simulation.RandomBot{Mistakes: *mistakes} }
+
+		res, err := simulation.Run(cfg)
+		played++
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\nreplay with: -seed %d -games 1 -players %d -mistakes %g\n", err, s, *players, *mistakes)
+			os.Exit(1)
+		}
+		steps += res.Steps
+		refused += res.Refused
+		if res.Winner != nil {
+			finished++
+		}
+	}
+	fmt.Printf("played %d games (%d finished) in %d moves, %d of them refused, without breaking any invariants\n", played, finished, steps, refused)
+}
@@ -1,39 +1,119 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"flag"
 	"fmt"
-	"math/rand"
-	"net/http"
+	"log/slog"
 	"os"
-	"time"
+	"os/signal"
+	"syscall"
 
 	"github.com/banool/trapwords"
 )
 
-const DEFAULT_PORT = "9002"
-
 func main() {
-	if len(os.Args) > 2 {
-		fmt.Fprintf(os.Stderr, "Too many arguments\n")
-		os.Exit(1)
+	cfg, printConfig, err := loadConfig(os.Args[1:])
+	if err == flag.ErrHelp {
+		os.Exit(0)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s\n", err)
+		os.Exit(2)
 	}
 
-	var port string
-	if len(os.Args) == 2 {
-		port = os.Args[1]
-	} else {
-		port = DEFAULT_PORT
+	if printConfig {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(cfg.Redacted()); err != nil {
+			fmt.Fprintf(os.Stderr, "error: %s\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	logger, err := cfg.NewLogger(os.Stderr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s\n", err)
+		os.Exit(2)
 	}
+	slog.SetDefault(logger)
 
-	rand.Seed(time.Now().UnixNano())
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
 	server := &trapwords.Server{
-		Server: http.Server{
-			Addr: ":" + port,
-		},
+		Config: cfg,
+		Logger: logger,
 	}
-	fmt.Printf("Starting server on port %s...\n", port)
-	if err := server.Start(); err != nil {
-		fmt.Fprintf(os.Stderr, "error: %s\n", err)
+	logger.Info("starting server", "addr", cfg.ListenAddr)
+	if err := server.Start(ctx); err != nil {
+		logger.Error("server stopped", "err", err)
+		os.Exit(1)
+	}
+}
+
+// loadConfig layers defaults, the config file, the environment and
+// then the flags given in args, in increasing order of precedence.
+func loadConfig(args []string) (trapwords.Config, bool, error) {
+	cfg := trapwords.DefaultConfig()
+
+	fs := flag.NewFlagSet("trapwords", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: trapwords [flags] [port]\n\n")
+		fs.PrintDefaults()
+		fmt.Fprintf(fs.Output(), "\nEvery setting can also be given in the config file or as a TRAPWORDS_* environment\n"+
+			"variable, e.g. TRAPWORDS_GAME_TTL=48h. Secrets (TRAPWORDS_ADMIN_TOKEN,\n"+
+			"TRAPWORDS_SESSION_SECRET) can only be set that way.\n")
 	}
+	configPath := fs.String("config", os.Getenv("TRAPWORDS_CONFIG"), "path to a JSON config file")
+	printConfig := fs.Bool("print-config", false, "print the effective config (with secrets redacted) and exit")
+	cfg.RegisterFlags(fs)
+
+	if err := fs.Parse(args); err != nil {
+		return cfg, false, err
+	}
+	if fs.NArg() > 1 {
+		return cfg, false, fmt.Errorf("too many arguments")
+	}
+	positional := fs.Args()
+
+	// The flags have already been written into cfg, but the file and
+	// environment must not override them, so remember which were set
+	// and apply them again at the end.
+	explicit := map[string]string{}
+	fs.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = f.Value.String()
+	})
+
+	cfg = trapwords.DefaultConfig()
+	if *configPath != "" {
+		if err := cfg.LoadFile(*configPath); err != nil {
+			return cfg, false, err
+		}
+	}
+	if err := cfg.ApplyEnv(os.LookupEnv); err != nil {
+		return cfg, false, err
+	}
+
+	// Rebind the flags to the layered config and replay the explicit ones.
+	fs = flag.NewFlagSet("trapwords", flag.ContinueOnError)
+	cfg.RegisterFlags(fs)
+	for name, value := range explicit {
+		if fs.Lookup(name) == nil {
+			continue
+		}
+		if err := fs.Set(name, value); err != nil {
+			return cfg, false, err
+		}
+	}
+
+	// For backwards compatibility a bare port may still be passed as
+	// the only positional argument.
+	if _, ok := explicit["listen"]; !ok && len(positional) == 1 {
+		cfg.ListenAddr = ":" + positional[0]
+	}
+
+	return cfg, *printConfig, cfg.Validate()
 }
@@ -0,0 +1,363 @@
+package trapwords
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// envPrefix is prepended to the upper-cased config key to form the
+// name of the environment variable that overrides it.
+const envPrefix = "TRAPWORDS_"
+
+// Config holds everything needed to run a Server. Values are layered:
+// defaults, then an optional JSON config file, then environment
+// variables, then command-line flags.
+type Config struct {
+	ListenAddr string `json:"listen_addr"`
+
+	// DevAssets serves assets straight from AssetRoot, re-reading
+	// them on every request, instead of from the copy embedded in the
+	// binary. It's meant for working on the frontend.
+	DevAssets bool `json:"dev_assets"`
+
+	// AssetRoot is the directory holding templates, javascript,
+	// stylesheets and images. It's only read when DevAssets is set.
+	AssetRoot string `json:"asset_root"`
+
+	// WordPackDir is the directory holding default-words.txt and
+	// game-id-words.txt. If empty, the word lists are read from the
+	// same place as the other assets.
+	WordPackDir string `json:"word_pack_dir"`
+
+	// CleanupInterval is how often idle games are looked for.
+	// CompletedGameTTL and GameTTL are how long finished and unfinished
+	// games are kept after they were last played.
+	CleanupInterval  Duration `json:"cleanup_interval"`
+	CompletedGameTTL Duration `json:"completed_game_ttl"`
+	GameTTL          Duration `json:"game_ttl"`
+
+	// MaxGames caps how many games are kept in memory. Once reached,
+	// the least recently played games are evicted. Zero means no cap.
+	MaxGames int `json:"max_games"`
+
+	// ShutdownTimeout bounds how long in-flight requests get to finish
+	// once the server has been asked to stop.
+	ShutdownTimeout Duration `json:"shutdown_timeout"`
+
+	// ShutdownDelay is how long /readyz reports the server as
+	// unavailable before it stops accepting connections, so load
+	// balancers stop routing to it first.
+	ShutdownDelay Duration `json:"shutdown_delay"`
+
+	Storage StorageConfig `json:"storage"`
+
+	RateLimits RateLimitConfig `json:"rate_limits"`
+
+	// TrustedProxies are the reverse proxies whose X-Forwarded-For
+	// headers are believed when working out a client's IP, for rate
+	// limiting and logging. Requests from anywhere else are taken to
+	// come from their own address.
+	TrustedProxies Networks `json:"trusted_proxies"`
+
+	// LogLevel is one of debug, info, warn or error. LogFormat is
+	// "text" for humans or "json" for log aggregators.
+	LogLevel  string `json:"log_level"`
+	LogFormat string `json:"log_format"`
+
+	// Secrets. These can be set from the config file or the
+	// environment but deliberately have no flags, so they never
+	// show up in process listings. Without a SessionSecret a random
+	// one is used, so players of private games must rejoin after a
+	// restart.
+	AdminToken    string `json:"admin_token"`
+	SessionSecret string `json:"session_secret"`
+}
+
+// StorageConfig selects where games are persisted.
+type StorageConfig struct {
+	// Backend is either "memory" (games are lost on restart) or
+	// "file" (one file per game in Path).
+	Backend string `json:"backend"`
+	Path    string `json:"path"`
+}
+
+// DefaultConfig returns the configuration used when nothing else is
+// specified.
+func DefaultConfig() Config {
+	return Config{
+		ListenAddr:       ":9002",
+		AssetRoot:        "assets",
+		CleanupInterval:  Duration{10 * time.Minute},
+		CompletedGameTTL: Duration{12 * time.Hour},
+		GameTTL:          Duration{24 * time.Hour},
+		ShutdownTimeout:  Duration{15 * time.Second},
+		Storage:          StorageConfig{Backend: "memory"},
+		RateLimits: RateLimitConfig{
+			GameCreation:  Limit{20, 10 * time.Minute},
+			WordFetch:     Limit{5, 10 * time.Minute},
+			ClientActions: Limit{120, time.Minute},
+			GameActions:   Limit{60, time.Minute},
+			JoinAttempts:  Limit{10, 10 * time.Minute},
+			Profiles:      Limit{5, time.Hour},
+		},
+		LogLevel:  "info",
+		LogFormat: "text",
+	}
+}
+
+// setDefaults fills in any zero fields from DefaultConfig, so a Server
+// constructed without a Config still starts.
+func (c *Config) setDefaults() {
+	d := DefaultConfig()
+	if c.ListenAddr == "" {
+		c.ListenAddr = d.ListenAddr
+	}
+	if c.AssetRoot == "" {
+		c.AssetRoot = d.AssetRoot
+	}
+	if c.CleanupInterval.Duration == 0 {
+		c.CleanupInterval = d.CleanupInterval
+	}
+	if c.CompletedGameTTL.Duration == 0 {
+		c.CompletedGameTTL = d.CompletedGameTTL
+	}
+	if c.GameTTL.Duration == 0 {
+		c.GameTTL = d.GameTTL
+	}
+	if c.ShutdownTimeout.Duration == 0 {
+		c.ShutdownTimeout = d.ShutdownTimeout
+	}
+	if c.Storage.Backend == "" {
+		c.Storage.Backend = d.Storage.Backend
+	}
+	if c.LogLevel == "" {
+		c.LogLevel = d.LogLevel
+	}
+	if c.LogFormat == "" {
+		c.LogFormat = d.LogFormat
+	}
+}
+
+// RegisterFlags binds the non-secret fields of c to flags in fs, using
+// the current values of c as the flag defaults.
+func (c *Config) RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.ListenAddr, "listen", c.ListenAddr, "address to listen on")
+	fs.BoolVar(&c.DevAssets, "dev-assets", c.DevAssets, "serve assets from the asset root instead of the embedded copy")
+	fs.StringVar(&c.AssetRoot, "asset-root", c.AssetRoot, "directory containing templates, scripts, stylesheets and images (with -dev-assets)")
+	fs.StringVar(&c.WordPackDir, "word-pack-dir", c.WordPackDir, "directory containing word lists (defaults to the assets)")
+	fs.DurationVar(&c.CleanupInterval.Duration, "cleanup-interval", c.CleanupInterval.Duration, "how often to look for expired games")
+	fs.DurationVar(&c.CompletedGameTTL.Duration, "completed-game-ttl", c.CompletedGameTTL.Duration, "how long to keep games that have a winner after their last activity")
+	fs.DurationVar(&c.GameTTL.Duration, "game-ttl", c.GameTTL.Duration, "how long to keep any game after its last activity")
+	fs.IntVar(&c.MaxGames, "max-games", c.MaxGames, "maximum number of games to keep, evicting the least recently played (0 for no limit)")
+	fs.DurationVar(&c.ShutdownTimeout.Duration, "shutdown-timeout", c.ShutdownTimeout.Duration, "how long to wait for in-flight requests when stopping")
+	fs.DurationVar(&c.ShutdownDelay.Duration, "shutdown-delay", c.ShutdownDelay.Duration, "how long to report not ready before stopping")
+	fs.StringVar(&c.Storage.Backend, "storage", c.Storage.Backend, `storage backend, "memory" or "file"`)
+	fs.StringVar(&c.Storage.Path, "storage-path", c.Storage.Path, "directory used by the file storage backend")
+	fs.Var(&c.RateLimits.GameCreation, "rate-limit-create", "games each client IP may create, e.g. 20/10m (0 for no limit)")
+	fs.Var(&c.RateLimits.WordFetch, "rate-limit-word-fetch", "custom word lists each client IP may fetch")
+	fs.Var(&c.RateLimits.ClientActions, "rate-limit-client-actions", "end turn, guess and next game requests per client IP")
+	fs.Var(&c.RateLimits.GameActions, "rate-limit-game-actions", "end turn, guess and next game requests per game")
+	fs.Var(&c.RateLimits.JoinAttempts, "rate-limit-join", "password attempts per client IP and game")
+	fs.Var(&c.RateLimits.Profiles, "rate-limit-profiles", "profiles each client IP may create")
+	fs.Var(&c.TrustedProxies, "trusted-proxies", "comma-separated addresses or CIDRs of reverse proxies whose X-Forwarded-For headers are trusted")
+	fs.StringVar(&c.LogLevel, "log-level", c.LogLevel, "minimum level to log: debug, info, warn or error")
+	fs.StringVar(&c.LogFormat, "log-format", c.LogFormat, `log format, "text" or "json"`)
+}
+
+// LoadFile overlays the JSON config file at path onto c. Keys missing
+// from the file leave the existing values untouched.
+func (c *Config) LoadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(c); err != nil {
+		return fmt.Errorf("parsing %s: %s", path, err)
+	}
+	return nil
+}
+
+// ApplyEnv overlays any TRAPWORDS_* environment variables onto c.
+// lookup is normally os.LookupEnv.
+func (c *Config) ApplyEnv(lookup func(string) (string, bool)) error {
+	strs := map[string]*string{
+		"LISTEN_ADDR":    &c.ListenAddr,
+		"ASSET_ROOT":     &c.AssetRoot,
+		"WORD_PACK_DIR":  &c.WordPackDir,
+		"STORAGE":        &c.Storage.Backend,
+		"STORAGE_PATH":   &c.Storage.Path,
+		"LOG_LEVEL":      &c.LogLevel,
+		"LOG_FORMAT":     &c.LogFormat,
+		"ADMIN_TOKEN":    &c.AdminToken,
+		"SESSION_SECRET": &c.SessionSecret,
+	}
+	for key, dst := range strs {
+		if v, ok := lookup(envPrefix + key); ok {
+			*dst = v
+		}
+	}
+
+	durations := map[string]*Duration{
+		"CLEANUP_INTERVAL":   &c.CleanupInterval,
+		"COMPLETED_GAME_TTL": &c.CompletedGameTTL,
+		"GAME_TTL":           &c.GameTTL,
+		"SHUTDOWN_TIMEOUT":   &c.ShutdownTimeout,
+		"SHUTDOWN_DELAY":     &c.ShutdownDelay,
+	}
+	for key, dst := range durations {
+		v, ok := lookup(envPrefix + key)
+		if !ok {
+			continue
+		}
+		if err := dst.UnmarshalText([]byte(v)); err != nil {
+			return fmt.Errorf("%s%s: %s", envPrefix, key, err)
+		}
+	}
+
+	ints := map[string]*int{
+		"MAX_GAMES": &c.MaxGames,
+	}
+	for key, dst := range ints {
+		v, ok := lookup(envPrefix + key)
+		if !ok {
+			continue
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("%s%s: %s", envPrefix, key, err)
+		}
+		*dst = n
+	}
+
+	limits := map[string]*Limit{
+		"RATE_LIMIT_CREATE":         &c.RateLimits.GameCreation,
+		"RATE_LIMIT_WORD_FETCH":     &c.RateLimits.WordFetch,
+		"RATE_LIMIT_CLIENT_ACTIONS": &c.RateLimits.ClientActions,
+		"RATE_LIMIT_GAME_ACTIONS":   &c.RateLimits.GameActions,
+		"RATE_LIMIT_JOIN":           &c.RateLimits.JoinAttempts,
+		"RATE_LIMIT_PROFILES":       &c.RateLimits.Profiles,
+	}
+	for key, dst := range limits {
+		v, ok := lookup(envPrefix + key)
+		if !ok {
+			continue
+		}
+		if err := dst.Set(v); err != nil {
+			return fmt.Errorf("%s%s: %s", envPrefix, key, err)
+		}
+	}
+
+	if v, ok := lookup(envPrefix + "TRUSTED_PROXIES"); ok {
+		if err := c.TrustedProxies.Set(v); err != nil {
+			return fmt.Errorf("%sTRUSTED_PROXIES: %s", envPrefix, err)
+		}
+	}
+
+	bools := map[string]*bool{
+		"DEV_ASSETS": &c.DevAssets,
+	}
+	for key, dst := range bools {
+		v, ok := lookup(envPrefix + key)
+		if !ok {
+			continue
+		}
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("%s%s: %s", envPrefix, key, err)
+		}
+		*dst = b
+	}
+	return nil
+}
+
+// Validate reports every problem with c at once.
+func (c Config) Validate() error {
+	var problems []string
+	if c.ListenAddr == "" {
+		problems = append(problems, "listen address must not be empty")
+	}
+	if c.DevAssets && c.AssetRoot == "" {
+		problems = append(problems, "development assets require an asset root")
+	}
+	if c.CleanupInterval.Duration <= 0 {
+		problems = append(problems, "cleanup interval must be positive")
+	}
+	if c.CompletedGameTTL.Duration <= 0 {
+		problems = append(problems, "completed game TTL must be positive")
+	}
+	if c.GameTTL.Duration <= 0 {
+		problems = append(problems, "game TTL must be positive")
+	}
+	if c.MaxGames < 0 {
+		problems = append(problems, "max games must not be negative")
+	}
+	if c.ShutdownTimeout.Duration <= 0 {
+		problems = append(problems, "shutdown timeout must be positive")
+	}
+	if c.ShutdownDelay.Duration < 0 {
+		problems = append(problems, "shutdown delay must not be negative")
+	}
+	switch c.Storage.Backend {
+	case "memory":
+	case "file":
+		if c.Storage.Path == "" {
+			problems = append(problems, "file storage requires a storage path")
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("unknown storage backend %q", c.Storage.Backend))
+	}
+	if _, err := c.NewLogger(io.Discard); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if len(problems) > 0 {
+		return errors.New("invalid config: " + strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// Redacted returns a copy of c with secrets masked, suitable for
+// printing or logging.
+func (c Config) Redacted() Config {
+	if c.AdminToken != "" {
+		c.AdminToken = "REDACTED"
+	}
+	if c.SessionSecret != "" {
+		c.SessionSecret = "REDACTED"
+	}
+	return c
+}
+
+func (c Config) assetPath(name string) string {
+	return filepath.Join(c.AssetRoot, name)
+}
+
+// Duration is a time.Duration that reads and writes itself as a
+// string like "10m" in config files.
+type Duration struct {
+	time.Duration
+}
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	v, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	d.Duration = v
+	return nil
+}
@@ -0,0 +1,327 @@
+package trapwords
+
+import (
+	"encoding/csv"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Kinds of Event.
+const (
+	EventStart    = "start"
+	EventTurn     = "turn"
+	EventGuess    = "guess"
+	EventSetRound = "set-round"
+	EventEnd      = "end"
+)
+
+// Event is something that happened in a game. Round and Phase are the
+// game's after the event.
+//
+// Players choose trapwords and give clues out loud, so neither is ever
+// known to the server; the events show when each phase started and who
+// ended it instead.
+type Event struct {
+	Time  time.Time `json:"time"`
+	Kind  string    `json:"kind"`
+	Round int       `json:"round"`
+	Phase Phase     `json:"phase"`
+	// PlayerID and Team are the player who acted and their team. For
+	// start and end events, Team is the starting and winning team.
+	PlayerID string `json:"player_id,omitempty"`
+	Team     Team   `json:"team,omitempty"`
+	// Words are the words to be guessed, whenever new ones are dealt.
+	Words []string `json:"words,omitempty"`
+	// Index and Cell are the cell guessed and whose it was.
+	Index *int   `json:"index,omitempty"`
+	Cell  string `json:"cell,omitempty"`
+}
+
+// newWordsRound reports whether new words are dealt at the start of
+// round.
+func newWordsRound(round int) bool {
+	return round == 0 || round == 5
+}
+
+// record adds e to the game's history.
+func (g *Game) record(e Event) {
+	e.Time = g.now()
+	e.Round = g.Round
+	e.Phase = g.Phase()
+	if newWordsRound(g.Round) && (e.Kind == EventStart || e.Kind == EventTurn || e.Kind == EventSetRound) {
+		e.Words = append([]string(nil), g.RoundWords...)
+	}
+	g.History = append(g.History, e)
+}
+
+// Scores counts something for each team, usually how many of their
+// cells were revealed.
+type Scores struct {
+	Red  int `json:"red"`
+	Blue int `json:"blue"`
+}
+
+// scores returns how many of each team's cells have been revealed.
+func (g *Game) scores() Scores {
+	var s Scores
+	for i, revealed := range g.Revealed {
+		switch {
+		case !revealed:
+		case g.Layout[i] == Red:
+			s.Red++
+		case g.Layout[i] == Blue:
+			s.Blue++
+		}
+	}
+	return s
+}
+
+// GameRecord is everything about a finished game: how it was set up,
+// who played, and what happened when.
+type GameRecord struct {
+	ID           string       `json:"id"`
+	Seed         int64        `json:"seed"`
+	WordSource   string       `json:"word_source"`
+	Private      bool         `json:"private"`
+	StartedAt    time.Time    `json:"started_at"`
+	EndedAt      time.Time    `json:"ended_at"`
+	Duration     float64      `json:"duration_seconds"`
+	StartingTeam Team         `json:"starting_team"`
+	WinningTeam  Team         `json:"winning_team"`
+	Scores       Scores       `json:"scores"`
+	Players      []PlayerInfo `json:"players"`
+	Layout       []Team       `json:"layout"`
+	Events       []Event      `json:"events"`
+	// MatchID and MatchGame are the match the game was part of, if
+	// any, and which game of it it was.
+	MatchID   string `json:"match_id,omitempty"`
+	MatchGame int    `json:"match_game,omitempty"`
+	// Room is the nonce of the room the game was played in, so that
+	// sessions for an earlier room with the same ID can't export it.
+	Room int64 `json:"room,omitempty"`
+}
+
+func newGameRecord(g *Game) *GameRecord {
+	r := &GameRecord{
+		ID:           g.ID,
+		Seed:         g.Seed,
+		WordSource:   g.WordSource,
+		Private:      g.Private,
+		Room:         g.RoomNonce,
+		StartedAt:    g.CreatedAt,
+		EndedAt:      g.lastActive(),
+		StartingTeam: g.StartingTeam,
+		Players:      []PlayerInfo{},
+		Layout:       g.Layout,
+		Events:       append([]Event(nil), g.History...),
+	}
+	if g.WinningTeam != nil {
+		r.WinningTeam = *g.WinningTeam
+	}
+	if n := len(g.History); n > 0 && g.History[n-1].Kind == EventEnd {
+		r.EndedAt = g.History[n-1].Time
+	}
+	r.Duration = r.EndedAt.Sub(r.StartedAt).Seconds()
+	r.Scores = g.scores()
+	if g.Match != nil && g.WinningTeam != nil {
+		r.MatchID, r.MatchGame = g.Match.ID, len(g.Match.Games)
+	}
+
+	for _, p := range g.everyone() {
+		if !p.Spectator {
+			r.Players = append(r.Players, p.info())
+		}
+	}
+	return r
+}
+
+// maxRecords bounds how many game records the server keeps in memory.
+// The file store keeps every record on disk regardless.
+const maxRecords = 10000
+
+// recordArchive holds the records of finished games, oldest first.
+type recordArchive struct {
+	mu      sync.Mutex
+	records []*GameRecord
+}
+
+func (a *recordArchive) add(rs ...*GameRecord) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.records = append(a.records, rs...)
+	sort.SliceStable(a.records, func(i, j int) bool {
+		return a.records[i].EndedAt.Before(a.records[j].EndedAt)
+	})
+	if len(a.records) > maxRecords {
+		a.records = append([]*GameRecord(nil), a.records[len(a.records)-maxRecords:]...)
+	}
+}
+
+// between returns the records of games that ended in [from, to). A zero
+// time leaves that end of the range open.
+func (a *recordArchive) between(from, to time.Time) []*GameRecord {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	records := []*GameRecord{}
+	for _, r := range a.records {
+		if (from.IsZero() || !r.EndedAt.Before(from)) && (to.IsZero() || r.EndedAt.Before(to)) {
+			records = append(records, r)
+		}
+	}
+	return records
+}
+
+// latest returns the record of the last game with id to finish.
+func (a *recordArchive) latest(id string) (*GameRecord, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for i := len(a.records) - 1; i >= 0; i-- {
+		if a.records[i].ID == id {
+			return a.records[i], true
+		}
+	}
+	return nil, false
+}
+
+// archive keeps g's record if it has just finished.
+func (s *Server) archive(g *Game) {
+	if g.WinningTeam == nil || g.Archived {
+		return
+	}
+	g.Archived = true
+	r := newGameRecord(g)
+	s.records.add(r)
+	s.recordProfileGames(r)
+	if err := s.store.SaveRecord(r); err != nil {
+		s.logger().Error("failed to archive game", "game_id", g.ID, "err", err)
+	}
+}
+
+// GET /api/v1/games/<id>/export
+//
+// Exports the game if it's finished, or otherwise the last game with
+// its ID to finish, even once the server has removed the game itself,
+// as JSON or, with format=csv, CSV.
+func (s *Server) handleExport(rw http.ResponseWriter, req *http.Request) {
+	format := req.FormValue("format")
+	if format != "" && format != "json" && format != "csv" {
+		writeError(rw, http.StatusBadRequest, "bad_request", "Format must be json or csv")
+		return
+	}
+
+	gameID := req.PathValue("id")
+	setGameID(req, gameID)
+	// Exporting doesn't join anyone to the game, so it only looks at
+	// the client's session, if they have one.
+	var r *GameRecord
+	e, live := s.games.get(gameID)
+	if live {
+		e.mu.Lock()
+		sess, joined := s.sessionFor(req, gameID, e.game.RoomNonce)
+		kicked, private := joined && e.game.Kicked[sess.PlayerID], e.game.Private
+		if e.game.WinningTeam != nil {
+			r = newGameRecord(e.game)
+		}
+		e.mu.Unlock()
+		switch {
+		case kicked:
+			writeError(rw, http.StatusForbidden, "kicked", "You were removed from this game")
+			return
+		case !joined && private:
+			writeError(rw, http.StatusUnauthorized, "private_game", "This game is private, join it with its password first")
+			return
+		}
+	}
+	if r == nil {
+		// The game is still going, or has been cleaned up since it
+		// finished, so export the last one to finish.
+		latest, ok := s.records.latest(gameID)
+		switch {
+		case !ok && live:
+			writeError(rw, http.StatusConflict, "game_in_progress", "The game hasn't finished yet")
+			return
+		case !ok:
+			writeError(rw, http.StatusNotFound, "game_not_found", "No such game")
+			return
+		case latest.Private:
+			if _, joined := s.sessionFor(req, gameID, latest.Room); !joined {
+				writeError(rw, http.StatusUnauthorized, "private_game", "This game is private, join it with its password first")
+				return
+			}
+		}
+		r = latest
+	}
+	writeRecords(rw, format, r.ID, []*GameRecord{r}, r)
+}
+
+// writeRecords writes rs in format, json or csv, naming the download
+// after name. JSON exports are written as body, which holds rs.
+func writeRecords(rw http.ResponseWriter, format, name string, rs []*GameRecord, body interface{}) {
+	if format != "csv" {
+		rw.Header().Set("Content-Disposition", `attachment; filename="`+downloadName(name)+`.json"`)
+		writeJSON(rw, body)
+		return
+	}
+	rw.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	rw.Header().Set("Content-Disposition", `attachment; filename="`+downloadName(name)+`.csv"`)
+	writeCSV(rw, rs)
+}
+
+// downloadName makes name safe to use as a file name.
+func downloadName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' {
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+// csvHeader lists the columns of a CSV export. Each row is one event,
+// with the game it belongs to summarised at the start.
+var csvHeader = []string{
+	"game_id", "started_at", "ended_at", "duration_seconds", "starting_team", "winning_team", "red_score", "blue_score",
+	"time", "event", "round", "phase", "player_id", "team", "words", "index", "cell",
+}
+
+func writeCSV(rw http.ResponseWriter, rs []*GameRecord) {
+	w := csv.NewWriter(rw)
+	w.Write(csvHeader)
+	for _, r := range rs {
+		game := []string{
+			r.ID,
+			r.StartedAt.UTC().Format(time.RFC3339),
+			r.EndedAt.UTC().Format(time.RFC3339),
+			strconv.FormatFloat(r.Duration, 'f', -1, 64),
+			r.StartingTeam.String(),
+			r.WinningTeam.String(),
+			strconv.Itoa(r.Scores.Red),
+			strconv.Itoa(r.Scores.Blue),
+		}
+		for _, e := range r.Events {
+			var team, index string
+			if e.Team != Neutral {
+				team = e.Team.String()
+			}
+			if e.Index != nil {
+				index = strconv.Itoa(*e.Index)
+			}
+			w.Write(append(game,
+				e.Time.UTC().Format(time.RFC3339),
+				e.Kind,
+				strconv.Itoa(e.Round),
+				string(e.Phase),
+				e.PlayerID,
+				team,
+				strings.Join(e.Words, " "),
+				index,
+				e.Cell,
+			))
+		}
+	}
+	w.Flush()
+}
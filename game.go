@@ -19,6 +19,10 @@ const roundsPerGame = 9
 
 const secondsPerGuess = 33
 
+// defaultWordSource is the WordSource of games using the server's own
+// word list.
+const defaultWordSource = "default"
+
 const (
 	Neutral Team = iota
 	Red
@@ -53,6 +57,20 @@ func (t Team) MarshalJSON() ([]byte, error) {
 	return json.Marshal(t.String())
 }
 
+func (t *Team) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	for _, team := range []Team{Neutral, Red, Blue, Black} {
+		if team.String() == s {
+			*t = team
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown team %q", s)
+}
+
 func (t Team) Repeat(n int) []Team {
 	s := make([]Team, n)
 	for i := 0; i < n; i++ {
@@ -65,10 +83,20 @@ func (t Team) Repeat(n int) []Team {
 // a Game's state. It's used to recreate games after
 // a process restart.
 type GameState struct {
-	Seed     int64  `json:"seed"`
+	Seed     int64  `json:"seed,omitempty"`
 	Round    int    `json:"round"`
 	GuessEnd int64  `json:"guessEnd"`
 	Revealed []bool `json:"revealed"`
+	// Private games can only be seen and played by clients holding a
+	// session for them. It's part of the state so that a game
+	// recreated from its state ID stays private.
+	Private bool `json:"private,omitempty"`
+	// RoomNonce is drawn when a room is created and kept for all of its
+	// games. Sessions carry it, so a session for a room that has been
+	// removed doesn't work in a new one with the same ID. It's part of
+	// the state so that a room recreated from its state ID still
+	// accepts its players' sessions.
+	RoomNonce int64 `json:"-"`
 }
 
 func (gs GameState) ID() string {
@@ -90,24 +118,53 @@ func decodeGameState(s string) (GameState, bool) {
 	return state, err == nil
 }
 
-func randomState() GameState {
+func randomState(rnd *rand.Rand) GameState {
 	return GameState{
-		Seed:     rand.Int63(),
+		Seed: rnd.Int63(),
 	}
 }
 
+// Game is one game played in a Room. The room's fields are promoted,
+// so g.Players is everyone in the room the game is being played in.
 type Game struct {
 	GameState
-	ID           string    `json:"id"`
-	CreatedAt    time.Time `json:"created_at"`
+	// ID is the room's ID, which GameState's ID method would otherwise
+	// make ambiguous.
+	ID string `json:"id"`
+	*Room
+	CreatedAt time.Time `json:"created_at"`
+	// LastActivity is when the game was last created or changed.
+	LastActivity time.Time `json:"-"`
 	StartingTeam Team      `json:"starting_team"`
 	WinningTeam  *Team     `json:"winning_team,omitempty"`
-	Words       []string   `json:"-"`
-	RoundWords  []string   `json:"words"`
-	Layout       []Team    `json:"layout"`
+	// Cluegiver is the player ID of the cluegiver during a guessing
+	// phase.
+	Cluegiver  string   `json:"cluegiver_id,omitempty"`
+	RoundWords []string `json:"words"`
+	Layout     []Team   `json:"layout"`
+	// Deals counts how many times words have been dealt in the game.
+	Deals int `json:"-"`
+	// History is everything that has happened in the game, for
+	// exporting it. Archived is set once the finished game's record
+	// has been archived.
+	History  []Event `json:"-"`
+	Archived bool    `json:"-"`
+
+	clock Clock
+}
+
+// now returns the time by the game's clock. Games restored from storage
+// may not have one until the server gives them its own.
+func (g *Game) now() time.Time {
+	if g.clock == nil {
+		return time.Now()
+	}
+	return g.clock.Now()
 }
 
-func (g *Game) checkWinningCondition() {
+// checkWinningCondition ends the game if by's guess revealed the last
+// of a team's cells.
+func (g *Game) checkWinningCondition(by *Player) {
 	if g.WinningTeam != nil {
 		return
 	}
@@ -124,55 +181,138 @@ func (g *Game) checkWinningCondition() {
 		}
 	}
 	if !redRemaining {
-		winners := Red
-		g.WinningTeam = &winners
+		g.setWinner(Red, by.ID)
 	}
 	if !blueRemaining {
-		winners := Blue
-		g.WinningTeam = &winners
+		g.setWinner(Blue, by.ID)
 	}
 }
 
-func (g *Game) NextTurn() error {
+// setWinner ends the game, with playerID's move deciding it.
+func (g *Game) setWinner(team Team, playerID string) {
+	g.WinningTeam = &team
+	g.record(Event{Kind: EventEnd, PlayerID: playerID, Team: team})
+	g.Match.finish(g)
+}
+
+// ForbiddenError is returned when a player tries something their team
+// or role doesn't allow in the current phase. Code identifies the
+// reason for programs.
+type ForbiddenError struct {
+	Code   string
+	Reason string
+}
+
+func (e *ForbiddenError) Error() string {
+	return e.Reason
+}
+
+func forbidden(code, format string, args ...interface{}) error {
+	return &ForbiddenError{Code: code, Reason: fmt.Sprintf(format, args...)}
+}
+
+// NextTurn moves the game on to the next round on behalf of by. During
+// the trapwords phase anyone on a team may do this; otherwise only the
+// team whose turn it is. Whoever ends a team's ready phase becomes its
+// cluegiver for the guessing phase that follows.
+func (g *Game) NextTurn(by *Player) error {
 	if g.WinningTeam != nil {
 		return errors.New("game is already over")
 	}
+	from := g.Phase()
+	if by.Team != Red && by.Team != Blue {
+		return forbidden("no_team", "Choose a team first")
+	}
+	if team := from.Team(); team != Neutral && by.Team != team {
+		return forbidden("not_your_turn", "It's %s team's turn", team)
+	}
+
+	g.nextRound(by)
+	if from.ready() {
+		g.Cluegiver = by.ID
+	}
+	return nil
+}
+
+// nextRound moves the game on to its next round on behalf of by,
+// starting over after the last.
+func (g *Game) nextRound(by *Player) {
 	g.Round++
-	if (g.Round == roundsPerGame) {
+	if g.Round == roundsPerGame {
 		g.Round = 0
 	}
-	if (g.Round == 0 || g.Round == 5) {
+	g.enterRound()
+	g.record(Event{Kind: EventTurn, PlayerID: by.ID, Team: by.Team})
+}
+
+// enterRound sets up the round the game has just moved to.
+func (g *Game) enterRound() {
+	if !g.Phase().guessing() {
+		g.Cluegiver = ""
+	}
+	if newWordsRound(g.Round) {
 		newWords(g, g.Words, g.GameState)
 	}
 	// See currentPhase in game.js
-	if (g.Round == 2 || g.Round == 4 || g.Round == 7 || g.Round == 9) {
+	if g.Round == 2 || g.Round == 4 || g.Round == 7 || g.Round == 9 {
 		// Start timer.
-		g.GuessEnd = int64(time.Now().Unix()) + secondsPerGuess
+		g.GuessEnd = g.now().Unix() + secondsPerGuess
 	} else {
 		g.GuessEnd = 0
 	}
+}
+
+// lastActive returns when the game was last active. Games saved before
+// activity was tracked fall back to their creation time.
+func (g *Game) lastActive() time.Time {
+	if g.LastActivity.IsZero() {
+		return g.CreatedAt
+	}
+	return g.LastActivity
+}
 
+// End finishes the game immediately with the given winner. Neutral
+// means nobody won.
+func (g *Game) End(winner Team) error {
+	if g.WinningTeam != nil {
+		return errors.New("game is already over")
+	}
+	g.setWinner(winner, "")
 	return nil
 }
 
-func (g *Game) Guess(idx int) error {
-	if idx > len(g.Layout) || idx < 0 {
+// Guess reveals the cell at idx on behalf of by, who must be guessing
+// for the team whose turn it is.
+func (g *Game) Guess(by *Player, idx int) error {
+	if g.WinningTeam != nil {
+		return errors.New("game is already over")
+	}
+	phase := g.Phase()
+	switch {
+	case !phase.guessing():
+		return forbidden("not_guessing", "Nobody is guessing right now")
+	case by.Team != phase.Team():
+		return forbidden("not_your_turn", "Only %s team can guess now", phase.Team())
+	case by.ID == g.Cluegiver:
+		return forbidden("cluegiver_cannot_guess", "The cluegiver can't guess")
+	}
+	if idx >= len(g.Layout) || idx < 0 {
 		return fmt.Errorf("index %d is invalid", idx)
 	}
 	if g.Revealed[idx] {
 		return errors.New("cell has already been revealed")
 	}
 	g.Revealed[idx] = true
+	g.record(Event{Kind: EventGuess, PlayerID: by.ID, Team: by.Team, Index: &idx, Cell: g.Layout[idx].String()})
 
 	if g.Layout[idx] == Black {
-		winners := g.CurrentTeam().Other()
-		g.WinningTeam = &winners
+		g.setWinner(phase.Team().Other(), by.ID)
 		return nil
 	}
 
-	g.checkWinningCondition()
-	if g.Layout[idx] != g.CurrentTeam() {
-		g.Round = g.Round + 1
+	g.checkWinningCondition(by)
+	if g.Layout[idx] != phase.Team() && g.WinningTeam == nil {
+		g.nextRound(by)
 	}
 	return nil
 }
@@ -184,9 +324,65 @@ func (g *Game) CurrentTeam() Team {
 	return g.StartingTeam.Other()
 }
 
+// Phase is what the players should be doing in a round. It mirrors
+// currentPhase and guessing in game.js.
+type Phase string
+
+const (
+	PhaseTrapwords    Phase = "trapwords"
+	PhaseBlueReady    Phase = "blue-ready"
+	PhaseBlueGuessing Phase = "blue-guessing"
+	PhaseRedReady     Phase = "red-ready"
+	PhaseRedGuessing  Phase = "red-guessing"
+)
+
+func phaseOf(round int) Phase {
+	switch round {
+	case 1, 8:
+		return PhaseBlueReady
+	case 2, 9:
+		return PhaseBlueGuessing
+	case 3, 6:
+		return PhaseRedReady
+	case 4, 7:
+		return PhaseRedGuessing
+	default:
+		return PhaseTrapwords
+	}
+}
+
+func (g *Game) Phase() Phase {
+	return phaseOf(g.Round)
+}
+
+// Team returns the team whose turn it is in phase p, or Neutral during
+// the trapwords phase when both teams play.
+func (p Phase) Team() Team {
+	switch p {
+	case PhaseBlueReady, PhaseBlueGuessing:
+		return Blue
+	case PhaseRedReady, PhaseRedGuessing:
+		return Red
+	default:
+		return Neutral
+	}
+}
+
+func (p Phase) ready() bool {
+	return p == PhaseBlueReady || p == PhaseRedReady
+}
+
+func (p Phase) guessing() bool {
+	return p == PhaseBlueGuessing || p == PhaseRedGuessing
+}
+
+// newWords deals game two random words. Each deal is seeded from the
+// game's seed and how many deals came before it, so every deal is
+// different but a game played again from the same seed gets the same
+// words.
 func newWords(game *Game, words []string, state GameState) error {
-	// Pick 2 random words.
-	rnd := rand.New(rand.NewSource(state.Seed % int64(time.Now().Unix())))
+	rnd := rand.New(rand.NewSource(state.Seed + int64(game.Deals)))
+	game.Deals++
 	used := map[string]struct{}{}
 	game.RoundWords = make([]string, 0, wordsPerGame)
 	for len(used) < wordsPerGame {
@@ -199,19 +395,29 @@ func newWords(game *Game, words []string, state GameState) error {
 	return nil
 }
 
-func newGame(id string, words []string, state GameState) *Game {
+// NewGame starts a game played with words in a new room, laid out
+// according to state's seed, that tells the time with clock.
+func NewGame(id string, words []string, state GameState, clock Clock) *Game {
+	return newGame(&Room{ID: id, Words: words}, state, clock)
+}
+
+func newGame(room *Room, state GameState, clock Clock) *Game {
 	rnd := rand.New(rand.NewSource(state.Seed))
+	now := clock.Now()
 	game := &Game{
-		ID:           id,
-		CreatedAt:    time.Now(),
+		Room:         room,
+		ID:           room.ID,
+		CreatedAt:    now,
+		LastActivity: now,
 		StartingTeam: Team(rnd.Intn(2)) + Red,
-		Words:        words,
 		RoundWords:   make([]string, 0, wordsPerGame),
 		Layout:       make([]Team, 0, wordsPerGame),
 		GameState:    state,
+		clock:        clock,
 	}
 
-	newWords(game, words, state)
+	newWords(game, room.Words, state)
+	game.record(Event{Kind: EventStart, Team: game.StartingTeam})
 
 	// Pick a random permutation of team assignments.
 	var teamAssignments []Team
@@ -226,6 +432,9 @@ func newGame(id string, words []string, state GameState) *Game {
 		shuffle(rnd, teamAssignments)
 	}
 	game.Layout = teamAssignments
+	if len(game.Revealed) != len(game.Layout) {
+		game.Revealed = make([]bool, len(game.Layout))
+	}
 	return game
 }
 
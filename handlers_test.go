@@ -0,0 +1,313 @@
+package trapwords
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata/handlers")
+
+// handlerStep is one request in TestHandlers. As names the player
+// making it, whose session cookies are kept between steps; steps with
+// no one named are made without cookies. Admin steps send the admin
+// token. Header is added to the request as given.
+type handlerStep struct {
+	name   string
+	as     string
+	admin  bool
+	header map[string]string
+	method string
+	path   string
+	body   string
+}
+
+// TestHandlers plays through every API route, including the ways each
+// can fail, through the same middleware as a real server, and compares
+// each response with a golden file. The web
+// client depends on the exact shape of these responses, so a change
+// here needs to be deliberate: rerun with -update and review the diff.
+func TestHandlers(t *testing.T) {
+	s := newTestServer()
+	s.Logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	s.Config.AdminToken = "admin-token"
+	// Profile creation is limited so that a step can be turned away.
+	s.limits = newRateLimiters(RateLimitConfig{Profiles: Limit{Count: 2, Per: time.Hour}}, s.clock())
+	if err := s.loadAssets(os.DirFS("assets")); err != nil {
+		t.Fatal(err)
+	}
+	s.mux = http.NewServeMux()
+	s.registerRoutes(s.mux)
+	handler := s.handler()
+	clock := s.Clock.(*fakeClock)
+
+	words := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		fmt.Fprintln(rw, "apple\nbanana\ncherry\ndamson")
+	}))
+	defer words.Close()
+
+	steps := []handlerStep{
+		{name: "stats", method: "GET", path: "/api/v1/stats"},
+		{name: "request-id", header: map[string]string{"X-Request-ID": "trace-1"}, method: "GET", path: "/api/v1/stats"},
+		{name: "openapi", method: "GET", path: "/api/v1/openapi.yaml"},
+		{name: "unknown-route", method: "GET", path: "/api/v1/nope"},
+		{name: "wrong-method", method: "GET", path: "/api/v1/games"},
+
+		{name: "create-bad-json", as: "host", method: "POST", path: "/api/v1/games", body: `{"id": `},
+		{name: "create-bad-link", as: "host", method: "POST", path: "/api/v1/games", body: `{"id": "g", "words_link": "ftp://example.com/words.txt"}`},
+		{name: "create", as: "host", method: "POST", path: "/api/v1/games", body: `{"id": "g"}`},
+		{name: "create-exists", as: "guest", method: "POST", path: "/api/v1/games", body: `{"id": "g"}`},
+		{name: "create-suggested-id", as: "creator", method: "POST", path: "/api/v1/games", body: `{}`},
+		{name: "create-with-link", as: "linker", method: "POST", path: "/api/v1/games", body: `{"id": "linked", "words_link": "` + words.URL + `"}`},
+
+		{name: "create-bad-match-length", as: "matcher", method: "POST", path: "/api/v1/games", body: `{"id": "match", "match_length": 99}`},
+		{name: "create-match", as: "matcher", method: "POST", path: "/api/v1/games", body: `{"id": "match", "match_length": 3}`},
+
+		{name: "get", as: "host", method: "GET", path: "/api/v1/games/g"},
+		{name: "get-unknown", as: "host", method: "GET", path: "/api/v1/games/unknown"},
+		{name: "get-from-state", as: "restorer", method: "GET", path: "/api/v1/games/restored?state_id={{state_id}}"},
+		{name: "join", as: "guest", method: "POST", path: "/api/v1/games/g/join"},
+		{name: "join-unknown", as: "guest", method: "POST", path: "/api/v1/games/unknown/join"},
+
+		{name: "end-turn-no-team", as: "host", method: "POST", path: "/api/v1/games/g/end-turn", body: `{}`},
+		{name: "team-invalid", as: "host", method: "POST", path: "/api/v1/games/g/team", body: `{"team": "black"}`},
+		{name: "team-unknown", as: "host", method: "POST", path: "/api/v1/games/g/team", body: `{"team": "purple"}`},
+		{name: "team-red", as: "host", method: "POST", path: "/api/v1/games/g/team", body: `{"team": "red"}`},
+		{name: "team-blue", as: "guest", method: "POST", path: "/api/v1/games/g/team", body: `{"team": "blue"}`},
+		{name: "team-not-joined", as: "other", method: "POST", path: "/api/v1/games/g/team", body: `{"team": "blue"}`},
+		{name: "get-not-joined", as: "other", method: "GET", path: "/api/v1/games/g"},
+		{name: "join-other", as: "other", method: "POST", path: "/api/v1/games/g/join"},
+		{name: "team-blue-2", as: "other", method: "POST", path: "/api/v1/games/g/team", body: `{"team": "blue"}`},
+
+		{name: "join-spectator", as: "watcher", method: "POST", path: "/api/v1/games/g/join", body: `{"spectator": true}`},
+		{name: "spectator-team", as: "watcher", method: "POST", path: "/api/v1/games/g/team", body: `{"team": "red"}`},
+		{name: "spectator-end-turn", as: "watcher", method: "POST", path: "/api/v1/games/g/end-turn", body: `{}`},
+		{name: "spectator-next-game", as: "watcher", method: "POST", path: "/api/v1/games/g/next-game", body: `{}`},
+		{name: "get-with-spectator", as: "host", method: "GET", path: "/api/v1/games/g"},
+
+		{name: "export-in-progress", as: "host", method: "GET", path: "/api/v1/games/g/export"},
+
+		{name: "end-turn-bad-json", as: "host", method: "POST", path: "/api/v1/games/g/end-turn", body: `[]`},
+		{name: "end-turn-stale", as: "host", method: "POST", path: "/api/v1/games/g/end-turn", body: `{"revision": 0}`},
+		{name: "end-turn", as: "host", method: "POST", path: "/api/v1/games/g/end-turn", body: `{"revision": {{revision}}}`},
+		{name: "end-turn-not-your-turn", as: "host", method: "POST", path: "/api/v1/games/g/end-turn", body: `{}`},
+		{name: "guess-not-guessing", as: "guest", method: "POST", path: "/api/v1/games/g/guess", body: `{"index": 0}`},
+		{name: "end-turn-ready", as: "guest", method: "POST", path: "/api/v1/games/g/end-turn", body: `{}`},
+		{name: "guess-cluegiver", as: "guest", method: "POST", path: "/api/v1/games/g/guess", body: `{"index": 0}`},
+		{name: "guess-wrong-team", as: "host", method: "POST", path: "/api/v1/games/g/guess", body: `{"index": 0}`},
+		{name: "guess-invalid-index", as: "other", method: "POST", path: "/api/v1/games/g/guess", body: `{"index": 20}`},
+		{name: "guess-negative-index", as: "other", method: "POST", path: "/api/v1/games/g/guess", body: `{"index": -1}`},
+		{name: "guess", as: "other", method: "POST", path: "/api/v1/games/g/guess", body: `{"index": {{blue}}}`},
+		{name: "guess-revealed", as: "other", method: "POST", path: "/api/v1/games/g/guess", body: `{"index": {{blue}}}`},
+		{name: "guess-black", as: "other", method: "POST", path: "/api/v1/games/g/guess", body: `{"index": {{black}}}`},
+		{name: "guess-game-over", as: "other", method: "POST", path: "/api/v1/games/g/guess", body: `{"index": 0}`},
+		{name: "end-turn-game-over", as: "guest", method: "POST", path: "/api/v1/games/g/end-turn", body: `{}`},
+		{name: "spectator-game-over", as: "watcher", method: "GET", path: "/api/v1/games/g"},
+		{name: "export", as: "host", method: "GET", path: "/api/v1/games/g/export"},
+		{name: "export-csv", as: "host", method: "GET", path: "/api/v1/games/g/export?format=csv"},
+		{name: "export-bad-format", as: "host", method: "GET", path: "/api/v1/games/g/export?format=xml"},
+		{name: "export-wrong-method", as: "host", method: "POST", path: "/api/v1/games/g/export"},
+
+		{name: "next-game-not-host", as: "guest", method: "POST", path: "/api/v1/games/g/next-game", body: `{}`},
+		{name: "next-game", as: "host", method: "POST", path: "/api/v1/games/g/next-game", body: `{}`},
+		{name: "export-previous-game", as: "host", method: "GET", path: "/api/v1/games/g/export"},
+		{name: "set-round-invalid", as: "host", method: "POST", path: "/api/v1/games/g/set-round", body: `{"round": 9}`},
+		{name: "set-round", as: "host", method: "POST", path: "/api/v1/games/g/set-round", body: `{"round": 4}`},
+		{name: "kick-self", as: "host", method: "POST", path: "/api/v1/games/g/kick", body: `{"player_id": "{{host}}"}`},
+		{name: "kick-unknown", as: "host", method: "POST", path: "/api/v1/games/g/kick", body: `{"player_id": "nobody"}`},
+		{name: "kick", as: "host", method: "POST", path: "/api/v1/games/g/kick", body: `{"player_id": "{{other}}"}`},
+		{name: "kicked", as: "other", method: "GET", path: "/api/v1/games/g"},
+
+		{name: "settings-not-host", as: "guest", method: "POST", path: "/api/v1/games/g/settings", body: `{"password": "secret"}`},
+		{name: "settings-private", as: "host", method: "POST", path: "/api/v1/games/g/settings", body: `{"password": "secret"}`},
+		{name: "private-no-session", method: "GET", path: "/api/v1/games/g"},
+		{name: "join-wrong-password", as: "newcomer", method: "POST", path: "/api/v1/games/g/join", body: `{"password": "wrong"}`},
+		{name: "join-private", as: "newcomer", method: "POST", path: "/api/v1/games/g/join", body: `{"password": "secret"}`},
+		{name: "settings-match", as: "host", method: "POST", path: "/api/v1/games/g/settings", body: `{"match_length": 5}`},
+		{name: "settings-match-bad-length", as: "host", method: "POST", path: "/api/v1/games/g/settings", body: `{"match_length": -1}`},
+		{name: "settings-no-match", as: "host", method: "POST", path: "/api/v1/games/g/settings", body: `{"match_length": 0}`},
+		{name: "settings-public", as: "host", method: "POST", path: "/api/v1/games/g/settings", body: `{"password": ""}`},
+		{name: "before-host-left", as: "guest", method: "GET", path: "/api/v1/games/g"},
+		{name: "leave", as: "host", method: "POST", path: "/api/v1/games/g/leave"},
+		{name: "after-host-left", as: "guest", method: "GET", path: "/api/v1/games/g"},
+
+		{name: "profile-none", as: "fan", method: "GET", path: "/api/v1/profiles/me"},
+		{name: "profile-create-no-name", as: "fan", method: "POST", path: "/api/v1/profiles", body: `{"name": "  "}`},
+		{name: "profile-create", as: "fan", method: "POST", path: "/api/v1/profiles", body: `{"name": "Fan", "league": "Office"}`},
+		{name: "profile-rate-limited", as: "spammer", method: "POST", path: "/api/v1/profiles", body: `{"name": "Spam"}`},
+		{name: "profile-me", as: "fan", method: "GET", path: "/api/v1/profiles/me"},
+		{name: "profile-rename", as: "fan", method: "POST", path: "/api/v1/profiles/me", body: `{"name": "Big Fan"}`},
+		{name: "profile-get", method: "GET", path: "/api/v1/profiles/{{fan-profile}}"},
+		{name: "profile-unknown", method: "GET", path: "/api/v1/profiles/nobody"},
+		{name: "profile-plays", as: "fan", method: "POST", path: "/api/v1/games/g/join"},
+		{name: "leaderboard", method: "GET", path: "/api/v1/leaderboard"},
+		{name: "leaderboard-league", method: "GET", path: "/api/v1/leagues/office/leaderboard?sort=win_rate"},
+		{name: "leaderboard-bad-sort", method: "GET", path: "/api/v1/leaderboard?sort=luck"},
+
+		{name: "legacy-stats", method: "GET", path: "/stats"},
+		{name: "legacy-game", as: "guest", method: "GET", path: "/game/g"},
+		{name: "legacy-create", as: "legacy", method: "POST", path: "/game/legacy"},
+		{name: "legacy-export", as: "guest", method: "GET", path: "/game/g/export"},
+		{name: "legacy-end-turn", as: "guest", method: "POST", path: "/end-turn", body: `{"game_id": "g"}`},
+		{name: "legacy-unknown-game", as: "guest", method: "POST", path: "/end-turn", body: `{"game_id": "unknown"}`},
+		{name: "legacy-join-removed", as: "guest", method: "POST", path: "/join", body: `{"game_id": "g"}`},
+
+		{name: "healthz", method: "GET", path: "/healthz"},
+		{name: "readyz", method: "GET", path: "/readyz"},
+		{name: "metrics", method: "GET", path: "/metrics"},
+
+		{name: "admin-no-token", method: "GET", path: "/admin/games"},
+		{name: "admin-bare-token", header: map[string]string{"Authorization": "admin-token"}, method: "GET", path: "/admin/games"},
+		{name: "admin-games", admin: true, method: "GET", path: "/admin/games"},
+		{name: "admin-game", admin: true, method: "GET", path: "/admin/games/g"},
+		{name: "admin-game-unknown", admin: true, method: "GET", path: "/admin/games/unknown"},
+		{name: "admin-games-wrong-method", admin: true, method: "POST", path: "/admin/games"},
+		{name: "admin-end", admin: true, method: "POST", path: "/admin/games/linked/end", body: `{"winning_team": "red"}`},
+		{name: "admin-export", admin: true, method: "GET", path: "/admin/export"},
+		{name: "admin-export-bad-format", admin: true, method: "GET", path: "/admin/export?format=xml"},
+		{name: "admin-delete", admin: true, method: "DELETE", path: "/admin/games/linked"},
+		{name: "export-deleted", method: "GET", path: "/api/v1/games/linked/export"},
+		{name: "export-unknown", method: "GET", path: "/api/v1/games/unknown/export"},
+		{name: "create-private", as: "keeper", method: "POST", path: "/api/v1/games", body: `{"id": "vault", "password": "one"}`},
+		{name: "admin-delete-private", admin: true, method: "DELETE", path: "/admin/games/vault"},
+		{name: "recreate-private", as: "newkeeper", method: "POST", path: "/api/v1/games", body: `{"id": "vault", "password": "two"}`},
+		{name: "recreated-old-session", as: "keeper", method: "GET", path: "/api/v1/games/vault"},
+		{name: "admin-cleanup", admin: true, method: "POST", path: "/admin/cleanup"},
+		{name: "admin-unknown-route", admin: true, method: "GET", path: "/admin/nope"},
+
+		{name: "index", method: "GET", path: "/"},
+		{name: "game-page", method: "GET", path: "/g"},
+		{name: "page-unknown", method: "GET", path: "/g/nope"},
+	}
+
+	// cookies and players hold each player's session cookies and player
+	// IDs, which are random, so they're replaced with the player's name
+	// in the golden files. Profile IDs and tokens are too, as
+	// <name-profile> and <name-token>.
+	cookies := make(map[string]map[string]*http.Cookie)
+	players := make(map[string]string)
+	// The word list server's port changes from run to run too.
+	players["words-link"] = words.URL
+	for _, step := range steps {
+		clock.Advance(time.Second)
+
+		vars := map[string]string{}
+		if e, ok := s.games.get("g"); ok {
+			e.mu.Lock()
+			vars["revision"] = strconv.FormatInt(e.game.Revision, 10)
+			vars["state_id"] = e.game.GameState.ID()
+			for i, team := range e.game.Layout {
+				vars[strings.ToLower(team.String())] = strconv.Itoa(i)
+			}
+			e.mu.Unlock()
+		}
+		for name, id := range players {
+			vars[name] = id
+		}
+		expand := func(s string) string {
+			for k, v := range vars {
+				s = strings.ReplaceAll(s, "{{"+k+"}}", v)
+			}
+			return s
+		}
+
+		var jar []*http.Cookie
+		for _, c := range cookies[step.as] {
+			jar = append(jar, c)
+		}
+		req := httptest.NewRequest(step.method, expand(step.path), strings.NewReader(expand(step.body)))
+		for _, c := range jar {
+			req.AddCookie(c)
+		}
+		if step.admin {
+			req.Header.Set("Authorization", "Bearer "+s.Config.AdminToken)
+		}
+		for k, v := range step.header {
+			req.Header.Set(k, v)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		// Request IDs are random unless the client sent one.
+		if step.header[requestIDHeader] == "" {
+			if rec.Header().Get(requestIDHeader) == "" {
+				t.Errorf("%s: no %s header", step.name, requestIDHeader)
+			}
+			rec.Header().Del(requestIDHeader)
+		}
+
+		if step.as != "" {
+			if cookies[step.as] == nil {
+				cookies[step.as] = make(map[string]*http.Cookie)
+			}
+			for _, c := range rec.Result().Cookies() {
+				cookies[step.as][c.Name] = c
+			}
+			var g GameResponse
+			if json.Unmarshal(rec.Body.Bytes(), &g) == nil && g.PlayerID != "" && players[step.as] == "" {
+				players[step.as] = g.PlayerID
+			}
+			var prof CreateProfileResponse
+			if json.Unmarshal(rec.Body.Bytes(), &prof) == nil && prof.Token != "" {
+				players[step.as+"-profile"] = prof.ID
+				players[step.as+"-token"] = prof.Token
+			}
+		}
+
+		got := formatResponse(rec, players)
+		path := filepath.Join("testdata", "handlers", step.name+".golden")
+		if *update {
+			if err := os.WriteFile(path, got, 0644); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		want, err := os.ReadFile(path)
+		if err != nil {
+			t.Errorf("%s: %v (run go test -update to create it)", step.name, err)
+			continue
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s: response changed\ngot:\n%s\nwant:\n%s", step.name, got, want)
+		}
+	}
+}
+
+// formatResponse writes out rec's status, the headers clients rely on
+// and its body, indented if it's JSON, with player IDs swapped for the
+// players' names. Only the first line of other bodies is kept.
+func formatResponse(rec *httptest.ResponseRecorder, players map[string]string) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "%d %s\n", rec.Code, http.StatusText(rec.Code))
+	for _, h := range []string{"Content-Type", "Allow", "Deprecation", "Link", "Retry-After", requestIDHeader} {
+		if v := rec.Header().Get(h); v != "" {
+			fmt.Fprintf(&b, "%s: %s\n", h, v)
+		}
+	}
+	b.WriteString("\n")
+
+	body := rec.Body.Bytes()
+	if strings.HasPrefix(rec.Header().Get("Content-Type"), "application/json") {
+		var indented bytes.Buffer
+		if err := json.Indent(&indented, body, "", "  "); err == nil {
+			body = append(indented.Bytes(), '\n')
+		}
+	} else if i := bytes.IndexByte(body, '\n'); i >= 0 {
+		body = body[:i+1]
+	}
+	for name, id := range players {
+		body = bytes.ReplaceAll(body, []byte(id), []byte("<"+name+">"))
+	}
+	b.Write(body)
+	return b.Bytes()
+}
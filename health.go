@@ -0,0 +1,51 @@
+package trapwords
+
+import (
+	"net/http"
+)
+
+type healthCheck struct {
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail,omitempty"`
+}
+
+type healthResponse struct {
+	Status string                 `json:"status"`
+	Checks map[string]healthCheck `json:"checks,omitempty"`
+}
+
+// GET /healthz
+//
+// Reports only that the process is up and serving requests.
+func (s *Server) handleHealthz(rw http.ResponseWriter, req *http.Request) {
+	writeJSON(rw, healthResponse{Status: "ok"})
+}
+
+// GET /readyz
+//
+// Reports whether the server should be sent traffic: its store is
+// reachable and it isn't shutting down. The server only starts
+// listening once its assets have loaded, so they always have.
+func (s *Server) handleReadyz(rw http.ResponseWriter, req *http.Request) {
+	checks := map[string]healthCheck{
+		"store":    {OK: true},
+		"shutdown": {OK: !s.shuttingDown.Load()},
+	}
+	if err := s.store.Ping(); err != nil {
+		checks["store"] = healthCheck{Detail: err.Error()}
+	}
+	if !checks["shutdown"].OK {
+		checks["shutdown"] = healthCheck{Detail: "shutting down"}
+	}
+
+	resp := healthResponse{Status: "ok", Checks: checks}
+	status := http.StatusOK
+	for _, c := range checks {
+		if !c.OK {
+			resp.Status = "unavailable"
+			status = http.StatusServiceUnavailable
+			break
+		}
+	}
+	writeJSONStatus(rw, status, resp)
+}
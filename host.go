@@ -0,0 +1,319 @@
+package trapwords
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// playerTimeout is how long a player can go without polling before
+// they're considered to have left. Clients poll every few seconds.
+// Players who leave keep their team if they come back.
+const playerTimeout = 30 * time.Second
+
+// Player is someone taking part in a game, identified by the player ID
+// in their session. ProfileID and Name are set if they're playing as a
+// profile. Spectators joined only to watch, and never have a team.
+type Player struct {
+	ID        string
+	Team      Team
+	Joined    time.Time
+	Seen      time.Time
+	ProfileID string
+	Name      string
+	Spectator bool
+}
+
+func (p *Player) info() PlayerInfo {
+	return PlayerInfo{ID: p.ID, Team: p.Team, ProfileID: p.ProfileID, Name: p.Name}
+}
+
+// touch records that playerID is still in the game, then makes sure
+// the game has a host who hasn't left.
+func (g *Game) touch(playerID string, now time.Time) {
+	if g.Players == nil {
+		g.Players = make(map[string]*Player)
+	}
+	p, ok := g.Players[playerID]
+	if !ok {
+		p = &Player{ID: playerID, Joined: now}
+		g.Players[playerID] = p
+	}
+	p.Seen = now
+	g.pickHost(now)
+}
+
+// present reports whether p is still in the game.
+func (p *Player) present(now time.Time) bool {
+	return now.Sub(p.Seen) <= playerTimeout
+}
+
+// leave marks playerID as having left the game, passing on the host
+// role if they had it.
+func (g *Game) leave(playerID string, now time.Time) {
+	if p, ok := g.Players[playerID]; ok {
+		p.Seen = time.Time{}
+	}
+	g.pickHost(now)
+}
+
+// pickHost hands the host role to whoever has been playing longest if
+// the host has left or is only watching.
+func (g *Game) pickHost(now time.Time) {
+	if p, ok := g.Players[g.HostID]; ok && p.present(now) && !p.Spectator {
+		return
+	}
+	g.HostID = ""
+	for id, p := range g.Players {
+		if !p.present(now) || p.Spectator {
+			continue
+		}
+		if g.HostID == "" || p.Joined.Before(g.Players[g.HostID].Joined) {
+			g.HostID = id
+		}
+	}
+}
+
+// setTeam puts playerID on team, which must be red or blue.
+func (g *Game) setTeam(playerID string, team Team) error {
+	if team != Red && team != Blue {
+		return fmt.Errorf("can't join the %s team", team)
+	}
+	p, ok := g.Players[playerID]
+	if !ok {
+		return errors.New("not in this game")
+	}
+	if p.Team != team && g.Cluegiver == playerID {
+		g.Cluegiver = ""
+	}
+	p.Team = team
+	return nil
+}
+
+// playerList returns the players still in the game in the order they
+// joined, leaving out spectators.
+func (g *Game) playerList(now time.Time) []PlayerInfo {
+	list := []PlayerInfo{}
+	for _, p := range g.everyone() {
+		if p.present(now) && !p.Spectator {
+			list = append(list, p.info())
+		}
+	}
+	return list
+}
+
+// everyone returns every player who has been in the game, including
+// those who have left, in the order they joined.
+func (g *Game) everyone() []*Player {
+	players := make([]*Player, 0, len(g.Players))
+	for _, p := range g.Players {
+		players = append(players, p)
+	}
+	sort.Slice(players, func(i, j int) bool {
+		return players[i].Joined.Before(players[j].Joined)
+	})
+	return players
+}
+
+// SetRound moves the game straight to round, as if the turns in
+// between had been played.
+func (g *Game) SetRound(round int) error {
+	if g.WinningTeam != nil {
+		return errors.New("game is already over")
+	}
+	if round < 0 || round >= roundsPerGame {
+		return fmt.Errorf("round %d is invalid", round)
+	}
+	g.Round = round
+	g.enterRound()
+	g.record(Event{Kind: EventSetRound})
+	return nil
+}
+
+// kick removes playerID from the game for good; their session no
+// longer works for it.
+func (g *Game) kick(playerID string, now time.Time) {
+	if g.Kicked == nil {
+		g.Kicked = make(map[string]bool)
+	}
+	g.Kicked[playerID] = true
+	delete(g.Players, playerID)
+	g.pickHost(now)
+}
+
+// requireHost writes a 403 and returns false unless sess belongs to
+// g's host.
+func requireHost(rw http.ResponseWriter, g *Game, sess session) bool {
+	if sess.PlayerID != g.HostID {
+		writeError(rw, http.StatusForbidden, "not_host", "Only the host can do that")
+		return false
+	}
+	return true
+}
+
+// hostMoved saves e's game if the host role has moved on from host.
+// Like any other change, that needs a new revision.
+func (s *Server) hostMoved(e *gameEntry, host string) {
+	if e.game.HostID != host {
+		s.gameChanged(e)
+	}
+}
+
+// hostRequest locks the game named in req's path, checking the request
+// comes from its host. On failure it has already written the response.
+func (s *Server) hostRequest(rw http.ResponseWriter, req *http.Request) (*gameEntry, session, bool) {
+	e := s.lockGame(rw, req, "")
+	if e == nil {
+		return nil, session{}, false
+	}
+	sess, ok := s.player(rw, req, e)
+	if !ok || !requirePlayer(rw, e.game, sess) || !requireHost(rw, e.game, sess) {
+		e.mu.Unlock()
+		return nil, session{}, false
+	}
+	return e, sess, true
+}
+
+// POST /api/v1/games/<id>/kick
+func (s *Server) handleKick(rw http.ResponseWriter, req *http.Request) {
+	var request KickRequest
+	if !decodeRequest(rw, req, &request) {
+		return
+	}
+
+	e, sess, ok := s.hostRequest(rw, req)
+	if !ok {
+		return
+	}
+	defer e.mu.Unlock()
+
+	if request.PlayerID == sess.PlayerID {
+		writeError(rw, http.StatusBadRequest, "invalid_action", "The host can't kick themselves")
+		return
+	}
+	if _, ok := e.game.Players[request.PlayerID]; !ok {
+		writeError(rw, http.StatusNotFound, "player_not_found", "No such player")
+		return
+	}
+	e.game.kick(request.PlayerID, s.now())
+	s.gameChanged(e)
+	s.logFor(req).Info("kicked player", "game_id", e.game.ID, "player_id", request.PlayerID)
+	writeGame(rw, e.game, sess)
+}
+
+// POST /api/v1/games/<id>/set-round
+func (s *Server) handleSetRound(rw http.ResponseWriter, req *http.Request) {
+	var request SetRoundRequest
+	if !decodeRequest(rw, req, &request) {
+		return
+	}
+
+	e, sess, ok := s.hostRequest(rw, req)
+	if !ok {
+		return
+	}
+	defer e.mu.Unlock()
+
+	g := e.game
+	if !checkRevision(rw, g, request.Revision) {
+		return
+	}
+	from := g.Phase()
+	if err := g.SetRound(request.Round); err != nil {
+		writeActionError(rw, err)
+		return
+	}
+	s.recordProgress(g, from)
+	s.gameChanged(e)
+	writeGame(rw, g, sess)
+}
+
+// POST /api/v1/games/<id>/settings
+//
+// Changes a game's settings: its password, an empty one making the game
+// public, and how many games its match is the best of, 0 meaning it's
+// not part of one.
+func (s *Server) handleSettings(rw http.ResponseWriter, req *http.Request) {
+	var request SettingsRequest
+	if !decodeRequest(rw, req, &request) {
+		return
+	}
+	if request.MatchLength != nil && !checkMatchLength(rw, *request.MatchLength) {
+		return
+	}
+
+	var password *gamePassword
+	if request.Password != nil && *request.Password != "" {
+		var err error
+		if password, err = hashPassword(*request.Password); err != nil {
+			writeError(rw, http.StatusInternalServerError, "internal", "Unable to set password")
+			return
+		}
+	}
+
+	e, sess, ok := s.hostRequest(rw, req)
+	if !ok {
+		return
+	}
+	defer e.mu.Unlock()
+
+	g := e.game
+	if request.MatchLength != nil {
+		if err := s.setMatchLength(g, *request.MatchLength); err != nil {
+			writeActionError(rw, err)
+			return
+		}
+	}
+	if request.Password != nil {
+		g.Password = password
+		g.Private = password != nil
+	}
+	s.gameChanged(e)
+	s.logFor(req).Info("changed game settings", "game_id", g.ID, "private", g.Private, "match_length", matchLength(g))
+	writeGame(rw, g, sess)
+}
+
+// POST /api/v1/games/<id>/leave
+//
+// Lets a player leave straight away rather than timing out, so the
+// host role moves on immediately.
+func (s *Server) handleLeave(rw http.ResponseWriter, req *http.Request) {
+	e := s.lockGame(rw, req, "")
+	if e == nil {
+		return
+	}
+	defer e.mu.Unlock()
+
+	if sess, ok := s.sessionFor(req, e.game.ID, e.game.RoomNonce); ok {
+		host := e.game.HostID
+		e.game.leave(sess.PlayerID, s.now())
+		s.hostMoved(e, host)
+	}
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+// setMatchLength makes g part of a match of length games, counting g
+// itself if it's finished, or takes it out of its match if length is 0.
+func (s *Server) setMatchLength(g *Game, length int) error {
+	switch {
+	case length == 0:
+		g.Match = nil
+	case g.Match == nil:
+		g.Match = newMatch(length, s.random())
+		if g.WinningTeam != nil {
+			g.Match.finish(g)
+		}
+	default:
+		return g.Match.setLength(length)
+	}
+	return nil
+}
+
+func matchLength(g *Game) int {
+	if g.Match == nil {
+		return 0
+	}
+	return g.Match.Length
+}
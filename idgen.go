@@ -0,0 +1,128 @@
+package trapwords
+
+import (
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// gameIDParts is how many words make up a suggested game ID.
+	gameIDParts = 3
+
+	// gameIDAttempts bounds how many IDs are tried at each stage
+	// before falling back to the next.
+	gameIDAttempts = 20
+
+	// gameIDReservation is how long a suggested ID is held back from
+	// other visitors, giving the lobby time to actually create it.
+	gameIDReservation = 5 * time.Minute
+)
+
+// gameIDGenerator suggests memorable, unused game IDs like
+// "lemon-harbor-quartz" for the lobby.
+type gameIDGenerator struct {
+	words []string
+	// taken reports whether a game with the given ID already exists.
+	taken func(id string) bool
+	clock Clock
+	rnd   *rand.Rand
+
+	mu       sync.Mutex
+	reserved map[string]time.Time
+}
+
+func newGameIDGenerator(words []string, clock Clock, rnd *rand.Rand, taken func(id string) bool) *gameIDGenerator {
+	lower := make([]string, 0, len(words))
+	for _, w := range words {
+		if isSimpleWord(w) {
+			lower = append(lower, strings.ToLower(w))
+		}
+	}
+	return &gameIDGenerator{
+		words:    lower,
+		taken:    taken,
+		clock:    clock,
+		rnd:      rnd,
+		reserved: make(map[string]time.Time),
+	}
+}
+
+// isSimpleWord reports whether w is made only of ASCII letters, so IDs
+// built from it are safe in URLs and easy to read out loud.
+func isSimpleWord(w string) bool {
+	if w == "" {
+		return false
+	}
+	for _, r := range w {
+		if (r < 'a' || r > 'z') && (r < 'A' || r > 'Z') {
+			return false
+		}
+	}
+	return true
+}
+
+// Suggest returns an ID that no game is using and that hasn't been
+// suggested to anyone else recently, and reserves it.
+func (g *gameIDGenerator) Suggest() string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	now := g.clock.Now()
+	for id, expires := range g.reserved {
+		if now.After(expires) {
+			delete(g.reserved, id)
+		}
+	}
+
+	var id string
+	for i := 0; i < gameIDAttempts; i++ {
+		id = g.combine()
+		if g.available(id) {
+			break
+		}
+		id = ""
+	}
+	// Almost every combination is in use, so add a random number,
+	// and failing that the time, which can't already be taken.
+	for i := 0; id == "" && i < gameIDAttempts; i++ {
+		id = g.combine() + "-" + strconv.Itoa(g.rnd.Intn(1000000))
+		if !g.available(id) {
+			id = ""
+		}
+	}
+	if id == "" {
+		id = g.combine() + "-" + strconv.FormatInt(now.UnixNano(), 36)
+	}
+
+	g.reserved[id] = now.Add(gameIDReservation)
+	return id
+}
+
+// Release drops the reservation on id, once a game has been created
+// with it.
+func (g *gameIDGenerator) Release(id string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	delete(g.reserved, id)
+}
+
+func (g *gameIDGenerator) available(id string) bool {
+	if _, ok := g.reserved[id]; ok {
+		return false
+	}
+	return !g.taken(id)
+}
+
+func (g *gameIDGenerator) combine() string {
+	if len(g.words) == 0 {
+		return "game"
+	}
+	parts := make([]string, gameIDParts)
+	for i := range parts {
+		parts[i] = g.words[g.rnd.Intn(len(g.words))]
+	}
+	return strings.Join(parts, "-")
+}
@@ -0,0 +1,143 @@
+package trapwords
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// requestIDHeader carries the request ID. An ID supplied by a proxy in
+// front of the server is kept so logs can be correlated across both.
+const requestIDHeader = "X-Request-ID"
+
+// NewLogger builds the logger described by the LogLevel and LogFormat
+// settings, writing to w.
+func (c Config) NewLogger(w io.Writer) (*slog.Logger, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(c.LogLevel)); err != nil {
+		return nil, fmt.Errorf("invalid log level %q", c.LogLevel)
+	}
+	opts := &slog.HandlerOptions{Level: level}
+
+	switch c.LogFormat {
+	case "", "text":
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	default:
+		return nil, fmt.Errorf("invalid log format %q", c.LogFormat)
+	}
+}
+
+func (s *Server) logger() *slog.Logger {
+	if s.Logger == nil {
+		return slog.Default()
+	}
+	return s.Logger
+}
+
+type requestInfoKey struct{}
+
+// requestInfo is attached to each request's context by logRequests.
+// Handlers fill in what only they know, like the game ID, so it ends
+// up in the access log line.
+type requestInfo struct {
+	logger *slog.Logger
+	gameID string
+}
+
+// logFor returns the logger for req, tagged with its request ID.
+func (s *Server) logFor(req *http.Request) *slog.Logger {
+	if info, ok := req.Context().Value(requestInfoKey{}).(*requestInfo); ok {
+		return info.logger
+	}
+	return s.logger()
+}
+
+// setGameID records which game req is about, for logging.
+func setGameID(req *http.Request, gameID string) {
+	if info, ok := req.Context().Value(requestInfoKey{}).(*requestInfo); ok {
+		info.gameID = gameID
+	}
+}
+
+// logRequests assigns every request an ID and logs it once it's done.
+func (s *Server) logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+
+		id := req.Header.Get(requestIDHeader)
+		if id == "" || len(id) > 64 || strings.ContainsAny(id, "\r\n") {
+			id = newRequestID()
+		}
+		rw.Header().Set(requestIDHeader, id)
+
+		info := &requestInfo{logger: s.logger().With("request_id", id)}
+		req = req.WithContext(context.WithValue(req.Context(), requestInfoKey{}, info))
+
+		rec := &statusRecorder{ResponseWriter: rw, status: http.StatusOK}
+		next.ServeHTTP(rec, req)
+
+		attrs := []any{
+			"method", req.Method,
+			"path", req.URL.Path,
+			"status", rec.status,
+			"latency", time.Since(start),
+			"remote", s.clientIP(req),
+		}
+		if info.gameID != "" {
+			attrs = append(attrs, "game_id", info.gameID)
+		}
+		level := slog.LevelInfo
+		if isProbe(req.URL.Path) && rec.status < 500 {
+			// Orchestrators probe constantly; only log failures.
+			level = slog.LevelDebug
+		} else if rec.status >= 500 {
+			level = slog.LevelError
+		}
+		info.logger.Log(req.Context(), level, "request", attrs...)
+	})
+}
+
+func isProbe(path string) bool {
+	return path == "/healthz" || path == "/readyz" || path == "/metrics"
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
+
+// statusRecorder remembers the status code written through it.
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if !r.wroteHeader {
+		r.status = status
+		r.wroteHeader = true
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	r.wroteHeader = true
+	return r.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
@@ -0,0 +1,156 @@
+package trapwords
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// maxMatchLength bounds how many games a match can be the best of.
+const maxMatchLength = 25
+
+// Match groups consecutive games in one place into a series of Length
+// games. A team wins the match by winning more than half of them; if
+// the games run out first, whoever won more does, and if neither did
+// the match is drawn. Games abandoned for the next game before they
+// finish don't count.
+type Match struct {
+	ID     string `json:"id"`
+	Length int    `json:"length"`
+	// Games are the match's finished games, in order.
+	Games []MatchGame `json:"games"`
+	// Wins counts the games each team has won, and Scores the cells
+	// each has revealed across them. They and Games swap when the
+	// players swap sides, so they count for the players now on each
+	// team.
+	Wins        Scores `json:"wins"`
+	Scores      Scores `json:"scores"`
+	WinningTeam *Team  `json:"winning_team,omitempty"`
+}
+
+// MatchGame is a finished game in a match, with the roster it was
+// played by.
+type MatchGame struct {
+	Number      int          `json:"number"`
+	WinningTeam Team         `json:"winning_team"`
+	Scores      Scores       `json:"scores"`
+	EndedAt     time.Time    `json:"ended_at"`
+	Players     []PlayerInfo `json:"players"`
+}
+
+func newMatch(length int, rnd *rand.Rand) *Match {
+	return &Match{
+		ID:     strconv.FormatUint(rnd.Uint64(), 36),
+		Length: length,
+		Games:  []MatchGame{},
+	}
+}
+
+// checkMatchLength writes a 400 and returns false unless length is a
+// valid match length, 0 meaning no match.
+func checkMatchLength(rw http.ResponseWriter, length int) bool {
+	if length < 0 || length > maxMatchLength {
+		writeError(rw, http.StatusBadRequest, "bad_request", fmt.Sprintf("Match length must be from 0 to %d games", maxMatchLength))
+		return false
+	}
+	return true
+}
+
+// over reports whether the match has been decided.
+func (m *Match) over() bool {
+	return m.WinningTeam != nil
+}
+
+// finish adds g, which has just been won, to the match.
+func (m *Match) finish(g *Game) {
+	if m == nil || m.over() {
+		return
+	}
+	game := MatchGame{
+		Number:      len(m.Games) + 1,
+		WinningTeam: *g.WinningTeam,
+		Scores:      g.scores(),
+		EndedAt:     g.now(),
+		Players:     []PlayerInfo{},
+	}
+	for _, p := range g.everyone() {
+		if p.Team == Red || p.Team == Blue {
+			game.Players = append(game.Players, p.info())
+		}
+	}
+	m.Games = append(m.Games, game)
+	switch game.WinningTeam {
+	case Red:
+		m.Wins.Red++
+	case Blue:
+		m.Wins.Blue++
+	}
+	m.Scores.Red += game.Scores.Red
+	m.Scores.Blue += game.Scores.Blue
+	m.decide()
+}
+
+// swap swaps red and blue throughout the match, its games included, for
+// when the players swap sides.
+func (m *Match) swap() {
+	m.Wins.Red, m.Wins.Blue = m.Wins.Blue, m.Wins.Red
+	m.Scores.Red, m.Scores.Blue = m.Scores.Blue, m.Scores.Red
+	if m.WinningTeam != nil {
+		winner := m.WinningTeam.Other()
+		m.WinningTeam = &winner
+	}
+	for i := range m.Games {
+		game := &m.Games[i]
+		game.WinningTeam = game.WinningTeam.Other()
+		game.Scores.Red, game.Scores.Blue = game.Scores.Blue, game.Scores.Red
+		for j := range game.Players {
+			game.Players[j].Team = game.Players[j].Team.Other()
+		}
+	}
+}
+
+// decide declares the match's winner once there is one.
+func (m *Match) decide() {
+	var winner Team
+	switch {
+	case m.over():
+		return
+	case m.Wins.Red*2 > m.Length:
+		winner = Red
+	case m.Wins.Blue*2 > m.Length:
+		winner = Blue
+	case len(m.Games) < m.Length:
+		return
+	case m.Wins.Red > m.Wins.Blue:
+		winner = Red
+	case m.Wins.Blue > m.Wins.Red:
+		winner = Blue
+	default:
+		winner = Neutral
+	}
+	m.WinningTeam = &winner
+}
+
+// setLength changes how many games the match is the best of.
+func (m *Match) setLength(length int) error {
+	if m.over() {
+		return fmt.Errorf("the match is over")
+	}
+	if length < len(m.Games) {
+		return fmt.Errorf("%d games of the match have already been played", len(m.Games))
+	}
+	m.Length = length
+	m.decide()
+	return nil
+}
+
+// next returns the match the next game belongs to: this one, or a
+// rematch of the same length if this one is over.
+func (m *Match) next(rnd *rand.Rand) *Match {
+	if m == nil || !m.over() {
+		return m
+	}
+	return newMatch(m.Length, rnd)
+}
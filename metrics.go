@@ -0,0 +1,302 @@
+package trapwords
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// This file implements just enough of the Prometheus text exposition
+// format to publish the server's metrics at /metrics.
+
+// latencyBuckets are histogram upper bounds, in seconds, suited to
+// request handling times.
+var latencyBuckets = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// serverMetrics holds everything the server reports.
+type serverMetrics struct {
+	gamesCreated      *counterVec
+	gamesCompleted    *counterVec
+	phaseTransitions  *counterVec
+	gamesRemoved      *counterVec
+	wordListFetches   *counterVec
+	wordListFetchTime *histogram
+	endTurnLatency    *histogram
+	pollers           *clientTracker
+	collectors        []collector
+}
+
+// newServerMetrics returns the server's metrics, telling the time with
+// clock.
+func newServerMetrics(clock Clock) *serverMetrics {
+	m := &serverMetrics{
+		gamesCreated: newCounterVec("trapwords_games_created_total",
+			"Games created, by where their words came from.", "source"),
+		gamesCompleted: newCounterVec("trapwords_games_completed_total",
+			"Games that finished, by winning team; neutral when an admin ended a game without a winner.", "winning_team"),
+		phaseTransitions: newCounterVec("trapwords_phase_transitions_total",
+			"Moves from one game phase to the next.", "from", "to"),
+		gamesRemoved: newCounterVec("trapwords_games_removed_total",
+			"Games removed by the cleanup loop, by reason.", "reason"),
+		wordListFetches: newCounterVec("trapwords_word_list_fetches_total",
+			"Attempts to fetch a custom word list from a link, by result.", "result"),
+		wordListFetchTime: newHistogram("trapwords_word_list_fetch_duration_seconds",
+			"Time taken to fetch a custom word list from a link.", latencyBuckets),
+		endTurnLatency: newHistogram("trapwords_end_turn_duration_seconds",
+			"Time taken to handle an end turn request.", latencyBuckets),
+		pollers: newClientTracker(10*time.Second, clock),
+	}
+	m.collectors = []collector{
+		m.gamesCreated,
+		m.gamesCompleted,
+		m.phaseTransitions,
+		m.gamesRemoved,
+		m.wordListFetches,
+		m.wordListFetchTime,
+		m.endTurnLatency,
+		&gaugeFunc{
+			name:   "trapwords_active_clients",
+			help:   "Clients that have polled a game in the last few seconds, by transport.",
+			labels: []string{"transport"},
+			fn: func() map[string]float64 {
+				return map[string]float64{"poll": float64(m.pollers.count())}
+			},
+		},
+	}
+	return m
+}
+
+// register adds a gauge whose value is computed on every scrape.
+func (m *serverMetrics) register(g *gaugeFunc) {
+	m.collectors = append(m.collectors, g)
+}
+
+func (m *serverMetrics) writeTo(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	for _, c := range m.collectors {
+		c.collect(bw)
+	}
+	return bw.Flush()
+}
+
+// GET /metrics
+func (s *Server) handleMetrics(rw http.ResponseWriter, req *http.Request) {
+	rw.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	s.metrics.writeTo(rw)
+}
+
+type collector interface {
+	collect(w io.Writer)
+}
+
+// counterVec is a set of counters sharing a name, one per combination
+// of label values.
+type counterVec struct {
+	name   string
+	help   string
+	labels []string
+
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	return &counterVec{
+		name:   name,
+		help:   help,
+		labels: labels,
+		values: make(map[string]float64),
+	}
+}
+
+// inc adds one to the counter with the given label values, which must
+// be in the same order as the labels passed to newCounterVec.
+func (c *counterVec) inc(labelValues ...string) {
+	key := formatLabels(c.labels, labelValues)
+	c.mu.Lock()
+	c.values[key]++
+	c.mu.Unlock()
+}
+
+func (c *counterVec) collect(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	writeHeader(w, c.name, c.help, "counter")
+	writeSamples(w, c.name, c.values)
+}
+
+// gaugeFunc is a gauge whose values are computed when scraped. fn
+// returns values keyed by the single label's value, or by "" when the
+// gauge has no labels.
+type gaugeFunc struct {
+	name   string
+	help   string
+	labels []string
+	fn     func() map[string]float64
+}
+
+func (g *gaugeFunc) collect(w io.Writer) {
+	values := make(map[string]float64)
+	for k, v := range g.fn() {
+		if len(g.labels) == 0 {
+			values[""] = v
+			continue
+		}
+		values[formatLabels(g.labels, []string{k})] = v
+	}
+	writeHeader(w, g.name, g.help, "gauge")
+	writeSamples(w, g.name, values)
+}
+
+type histogram struct {
+	name    string
+	help    string
+	buckets []float64
+
+	mu     sync.Mutex
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func newHistogram(name, help string, buckets []float64) *histogram {
+	return &histogram{
+		name:    name,
+		help:    help,
+		buckets: buckets,
+		counts:  make([]uint64, len(buckets)),
+	}
+}
+
+func (h *histogram) observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, upper := range h.buckets {
+		if v <= upper {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+// since observes the seconds elapsed since start.
+func (h *histogram) since(start time.Time) {
+	h.observe(time.Since(start).Seconds())
+}
+
+func (h *histogram) collect(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	writeHeader(w, h.name, h.help, "histogram")
+	for i, upper := range h.buckets {
+		fmt.Fprintf(w, "%s_bucket{le=%q} %d\n", h.name, formatFloat(upper), h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", h.name, h.count)
+	fmt.Fprintf(w, "%s_sum %s\n", h.name, formatFloat(h.sum))
+	fmt.Fprintf(w, "%s_count %d\n", h.name, h.count)
+}
+
+// clientTracker counts distinct clients per game seen within a
+// sliding window.
+type clientTracker struct {
+	window time.Duration
+	clock  Clock
+
+	mu       sync.Mutex
+	lastSeen map[string]map[string]time.Time
+}
+
+func newClientTracker(window time.Duration, clock Clock) *clientTracker {
+	return &clientTracker{
+		window:   window,
+		clock:    clock,
+		lastSeen: make(map[string]map[string]time.Time),
+	}
+}
+
+func (t *clientTracker) seen(gameID, client string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	// Prune here as well as when scraped, so games nobody polls any more
+	// don't pile up on servers that aren't scraped.
+	t.prune()
+	clients, ok := t.lastSeen[gameID]
+	if !ok {
+		clients = make(map[string]time.Time)
+		t.lastSeen[gameID] = clients
+	}
+	clients[client] = t.clock.Now()
+}
+
+// count returns the number of recent clients across all games.
+func (t *clientTracker) count() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.prune()
+	var n int
+	for _, clients := range t.lastSeen {
+		n += len(clients)
+	}
+	return n
+}
+
+func (t *clientTracker) prune() {
+	cutoff := t.clock.Now().Add(-t.window)
+	for gameID, clients := range t.lastSeen {
+		for c, last := range clients {
+			if last.Before(cutoff) {
+				delete(clients, c)
+			}
+		}
+		if len(clients) == 0 {
+			delete(t.lastSeen, gameID)
+		}
+	}
+}
+
+func writeHeader(w io.Writer, name, help, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func writeSamples(w io.Writer, name string, values map[string]float64) {
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s%s %s\n", name, k, formatFloat(values[k]))
+	}
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		var v string
+		if i < len(values) {
+			v = values[i]
+		}
+		pairs[i] = name + `="` + labelValueEscaper.Replace(v) + `"`
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, +1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
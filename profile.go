@@ -0,0 +1,425 @@
+package trapwords
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Profile is a player's identity across games. There are no accounts:
+// whoever holds a profile's device token is that player. Only a hash
+// of the token is kept.
+type Profile struct {
+	ID        string       `json:"id"`
+	Name      string       `json:"name"`
+	League    string       `json:"league,omitempty"`
+	CreatedAt time.Time    `json:"created_at"`
+	Stats     ProfileStats `json:"stats"`
+	// Games are the profile's most recent games, newest first.
+	Games     []ProfileGame `json:"games"`
+	TokenHash []byte        `json:"-"`
+}
+
+// ProfileStats totals a profile's finished games. A guess that reveals
+// one of the player's own team's cells counts as a word guessed; one
+// that reveals any other cell, ending their team's turn, counts as
+// being trapped.
+type ProfileStats struct {
+	Games        int `json:"games"`
+	Wins         int `json:"wins"`
+	WordsGuessed int `json:"words_guessed"`
+	TimesTrapped int `json:"times_trapped"`
+}
+
+func (s *ProfileStats) add(o ProfileStats) {
+	s.Games += o.Games
+	s.Wins += o.Wins
+	s.WordsGuessed += o.WordsGuessed
+	s.TimesTrapped += o.TimesTrapped
+}
+
+// ProfileGame is one game a profile played.
+type ProfileGame struct {
+	GameID  string    `json:"game_id"`
+	EndedAt time.Time `json:"ended_at"`
+	Team    Team      `json:"team"`
+	Won     bool      `json:"won"`
+	ProfileStats
+}
+
+// maxProfileGames bounds how many games each profile lists. Its stats
+// count every game regardless.
+const maxProfileGames = 100
+
+// Names and leagues are limited to this many characters.
+const maxProfileName = 32
+
+func (p *Profile) clone() *Profile {
+	c := *p
+	c.Games = append([]ProfileGame{}, p.Games...)
+	return &c
+}
+
+// profileRegistry holds every profile, by ID and by token hash.
+type profileRegistry struct {
+	mu     sync.Mutex
+	byID   map[string]*Profile
+	byHash map[string]*Profile
+	// saving holds a lock per profile, held from changing the profile
+	// until the change is saved.
+	saving map[string]*sync.Mutex
+}
+
+func newProfileRegistry() *profileRegistry {
+	return &profileRegistry{
+		byID:   make(map[string]*Profile),
+		byHash: make(map[string]*Profile),
+		saving: make(map[string]*sync.Mutex),
+	}
+}
+
+func (r *profileRegistry) add(p *Profile) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.byID[p.ID] = p
+	r.byHash[string(p.TokenHash)] = p
+}
+
+// get returns a copy of the profile id.
+func (r *profileRegistry) get(id string) (*Profile, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	p, ok := r.byID[id]
+	if !ok {
+		return nil, false
+	}
+	return p.clone(), true
+}
+
+// forToken returns a copy of the profile token belongs to.
+func (r *profileRegistry) forToken(token string) (*Profile, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	p, ok := r.byHash[string(hashToken(token))]
+	if !ok {
+		return nil, false
+	}
+	return p.clone(), true
+}
+
+// update calls fn on the profile id, then save on a copy of the
+// result, which it returns along with save's error. Changes to a
+// profile are saved in the order they were made, so an older copy never
+// overwrites a newer one. Only the profile's own changes wait for the
+// save; reading it doesn't.
+func (r *profileRegistry) update(id string, fn func(*Profile), save func(*Profile) error) (*Profile, bool, error) {
+	r.mu.Lock()
+	lock, ok := r.saving[id]
+	if !ok {
+		lock = new(sync.Mutex)
+		r.saving[id] = lock
+	}
+	r.mu.Unlock()
+	lock.Lock()
+	defer lock.Unlock()
+
+	r.mu.Lock()
+	p, ok := r.byID[id]
+	if !ok {
+		r.mu.Unlock()
+		return nil, false, nil
+	}
+	fn(p)
+	prof := p.clone()
+	r.mu.Unlock()
+	return prof, true, save(prof)
+}
+
+// all returns a copy of every profile.
+func (r *profileRegistry) all() []*Profile {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	profiles := make([]*Profile, 0, len(r.byID))
+	for _, p := range r.byID {
+		profiles = append(profiles, p.clone())
+	}
+	return profiles
+}
+
+func newProfileToken() string {
+	b := make([]byte, 24)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func hashToken(token string) []byte {
+	sum := sha256.Sum256([]byte(token))
+	return sum[:]
+}
+
+// profileCookieName is the cookie holding a browser's device token.
+const profileCookieName = "trapwords_profile"
+
+// profileTokenLifetime is how long a browser keeps its device token.
+const profileTokenLifetime = 5 * 365 * 24 * time.Hour
+
+// profileFor returns the profile of the client making req, who may
+// send their device token as a cookie or a bearer token.
+func (s *Server) profileFor(req *http.Request) (*Profile, bool) {
+	token, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		c, err := req.Cookie(profileCookieName)
+		if err != nil {
+			return nil, false
+		}
+		token = c.Value
+	}
+	return s.profiles.forToken(token)
+}
+
+// linkProfile notes in g which profile, if any, playerID is playing
+// as. Names can change, so this happens on every request.
+func (s *Server) linkProfile(req *http.Request, g *Game, playerID string) {
+	p, ok := g.Players[playerID]
+	if !ok {
+		return
+	}
+	if prof, ok := s.profileFor(req); ok {
+		p.ProfileID, p.Name = prof.ID, prof.Name
+	}
+}
+
+// recordProfileGames adds the game in r to the stats of every profile
+// that played it on a team.
+func (s *Server) recordProfileGames(r *GameRecord) {
+	for _, player := range r.Players {
+		if player.ProfileID == "" || (player.Team != Red && player.Team != Blue) {
+			continue
+		}
+		game := ProfileGame{
+			GameID:       r.ID,
+			EndedAt:      r.EndedAt,
+			Team:         player.Team,
+			Won:          player.Team == r.WinningTeam,
+			ProfileStats: ProfileStats{Games: 1},
+		}
+		if game.Won {
+			game.Wins = 1
+		}
+		for _, e := range r.Events {
+			if e.Kind != EventGuess || e.PlayerID != player.ID {
+				continue
+			}
+			if e.Cell == player.Team.String() {
+				game.WordsGuessed++
+			} else {
+				game.TimesTrapped++
+			}
+		}
+
+		_, ok, err := s.profiles.update(player.ProfileID, func(p *Profile) {
+			p.Stats.add(game.ProfileStats)
+			p.Games = append([]ProfileGame{game}, p.Games...)
+			if len(p.Games) > maxProfileGames {
+				p.Games = p.Games[:maxProfileGames]
+			}
+		}, s.store.SaveProfile)
+		if ok && err != nil {
+			s.logger().Error("failed to save profile", "profile_id", player.ProfileID, "err", err)
+		}
+	}
+}
+
+// cleanProfileText trims s, a name or league, and reports whether it's
+// short enough.
+func cleanProfileText(s string) (string, bool) {
+	s = strings.TrimSpace(s)
+	return s, utf8.RuneCountInString(s) <= maxProfileName
+}
+
+// POST /api/v1/profiles
+//
+// Creates a profile and hands its device token back, both in the body
+// and as a cookie.
+func (s *Server) handleCreateProfile(rw http.ResponseWriter, req *http.Request) {
+	var request CreateProfileRequest
+	if !decodeRequest(rw, req, &request) {
+		return
+	}
+	name, ok := cleanProfileText(request.Name)
+	if !ok || name == "" {
+		writeError(rw, http.StatusBadRequest, "bad_request", "Names must be 1 to 32 characters")
+		return
+	}
+	league, ok := cleanProfileText(request.League)
+	if !ok {
+		writeError(rw, http.StatusBadRequest, "bad_request", "Leagues must be at most 32 characters")
+		return
+	}
+
+	token := newProfileToken()
+	prof := &Profile{
+		ID:        newPlayerID(),
+		Name:      name,
+		League:    strings.ToLower(league),
+		CreatedAt: s.now(),
+		Games:     []ProfileGame{},
+		TokenHash: hashToken(token),
+	}
+	if err := s.store.SaveProfile(prof); err != nil {
+		s.logFor(req).Error("failed to save profile", "err", err)
+		writeError(rw, http.StatusInternalServerError, "internal", "Couldn't save the profile")
+		return
+	}
+	s.profiles.add(prof)
+
+	http.SetCookie(rw, &http.Cookie{
+		Name:     profileCookieName,
+		Value:    token,
+		Path:     "/",
+		MaxAge:   int(profileTokenLifetime.Seconds()),
+		HttpOnly: true,
+		Secure:   req.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	s.logFor(req).Info("created profile", "profile_id", prof.ID)
+	writeJSONStatus(rw, http.StatusCreated, CreateProfileResponse{Profile: prof.clone(), Token: token})
+}
+
+// GET or POST /api/v1/profiles/me
+//
+// Fetches or, with a POST, renames the client's own profile or moves it
+// to another league.
+func (s *Server) handleMyProfile(rw http.ResponseWriter, req *http.Request) {
+	prof, ok := s.profileFor(req)
+	if !ok {
+		writeError(rw, http.StatusUnauthorized, "no_profile", "Create a profile first")
+		return
+	}
+	if req.Method == "GET" {
+		writeJSON(rw, prof)
+		return
+	}
+
+	var request UpdateProfileRequest
+	if !decodeRequest(rw, req, &request) {
+		return
+	}
+	var name, league string
+	if request.Name != nil {
+		if name, ok = cleanProfileText(*request.Name); !ok || name == "" {
+			writeError(rw, http.StatusBadRequest, "bad_request", "Names must be 1 to 32 characters")
+			return
+		}
+	}
+	if request.League != nil {
+		if league, ok = cleanProfileText(*request.League); !ok {
+			writeError(rw, http.StatusBadRequest, "bad_request", "Leagues must be at most 32 characters")
+			return
+		}
+	}
+	prof, ok, err := s.profiles.update(prof.ID, func(p *Profile) {
+		if request.Name != nil {
+			p.Name = name
+		}
+		if request.League != nil {
+			p.League = strings.ToLower(league)
+		}
+	}, s.store.SaveProfile)
+	if !ok {
+		writeError(rw, http.StatusUnauthorized, "no_profile", "Create a profile first")
+		return
+	}
+	if err != nil {
+		s.logFor(req).Error("failed to save profile", "profile_id", prof.ID, "err", err)
+	}
+	writeJSON(rw, prof)
+}
+
+// GET /api/v1/profiles/<id>
+func (s *Server) handleGetProfile(rw http.ResponseWriter, req *http.Request, id string) {
+	prof, ok := s.profiles.get(id)
+	if !ok {
+		writeError(rw, http.StatusNotFound, "profile_not_found", "No such profile")
+		return
+	}
+	writeJSON(rw, prof)
+}
+
+// leaderboardSorts are the ways a leaderboard can be ranked, by the
+// name of the sort query parameter.
+var leaderboardSorts = map[string]func(a, b ProfileStats) bool{
+	"wins":          func(a, b ProfileStats) bool { return a.Wins > b.Wins },
+	"games":         func(a, b ProfileStats) bool { return a.Games > b.Games },
+	"words_guessed": func(a, b ProfileStats) bool { return a.WordsGuessed > b.WordsGuessed },
+	"win_rate":      func(a, b ProfileStats) bool { return a.Wins*b.Games > b.Wins*a.Games },
+}
+
+// Leaderboards list this many profiles unless asked for fewer.
+const maxLeaderboard = 100
+
+// GET /api/v1/leaderboard and /api/v1/leagues/<league>/leaderboard
+//
+// Ranks the profiles that have finished a game, everyone's or one
+// league's, by sort (wins by default), with ties going to whoever has
+// played more.
+func (s *Server) handleLeaderboard(rw http.ResponseWriter, req *http.Request, league string) {
+	sortBy := req.FormValue("sort")
+	if sortBy == "" {
+		sortBy = "wins"
+	}
+	better, ok := leaderboardSorts[sortBy]
+	if !ok {
+		writeError(rw, http.StatusBadRequest, "bad_request", "Sort by wins, games, words_guessed or win_rate")
+		return
+	}
+	limit := maxLeaderboard
+	if v := req.FormValue("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			writeError(rw, http.StatusBadRequest, "bad_request", "Limit must be a positive number")
+			return
+		}
+		if n < limit {
+			limit = n
+		}
+	}
+	league = strings.ToLower(league)
+
+	var entries []LeaderboardEntry
+	for _, p := range s.profiles.all() {
+		if p.Stats.Games == 0 || league != "" && p.League != league {
+			continue
+		}
+		entries = append(entries, LeaderboardEntry{ProfileID: p.ID, Name: p.Name, League: p.League, Stats: p.Stats})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		switch {
+		case better(a.Stats, b.Stats):
+			return true
+		case better(b.Stats, a.Stats):
+			return false
+		case a.Stats.Games != b.Stats.Games:
+			return a.Stats.Games > b.Stats.Games
+		}
+		return a.ProfileID < b.ProfileID
+	})
+	if len(entries) > limit {
+		entries = entries[:limit]
+	}
+	for i := range entries {
+		entries[i].Rank = i + 1
+	}
+	if entries == nil {
+		entries = []LeaderboardEntry{}
+	}
+	writeJSON(rw, LeaderboardResponse{League: league, Sort: sortBy, Entries: entries})
+}
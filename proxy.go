@@ -0,0 +1,97 @@
+package trapwords
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// Networks is a list of IP networks, written as comma-separated CIDRs
+// or bare addresses, e.g. "10.0.0.0/8,127.0.0.1".
+type Networks []netip.Prefix
+
+func (n Networks) String() string {
+	parts := make([]string, len(n))
+	for i, p := range n {
+		parts[i] = p.String()
+	}
+	return strings.Join(parts, ",")
+}
+
+// Set implements flag.Value.
+func (n *Networks) Set(s string) error {
+	var networks Networks
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		if !strings.Contains(part, "/") {
+			addr, err := netip.ParseAddr(part)
+			if err != nil {
+				return fmt.Errorf("%q is not an IP address or network", part)
+			}
+			networks = append(networks, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		p, err := netip.ParsePrefix(part)
+		if err != nil {
+			return fmt.Errorf("%q is not an IP address or network", part)
+		}
+		networks = append(networks, p.Masked())
+	}
+	*n = networks
+	return nil
+}
+
+func (n Networks) MarshalText() ([]byte, error) {
+	return []byte(n.String()), nil
+}
+
+func (n *Networks) UnmarshalText(text []byte) error {
+	return n.Set(string(text))
+}
+
+// contains reports whether addr is in any of the networks.
+func (n Networks) contains(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, p := range n {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the address of the client that made req, without
+// the port. Requests from a trusted proxy are attributed to the last
+// address in X-Forwarded-For that isn't another trusted proxy, so one
+// client can't pose as many by making up the rest of the header.
+func (s *Server) clientIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	proxies := s.Config.TrustedProxies
+	addr, err := netip.ParseAddr(host)
+	if err != nil || !proxies.contains(addr) {
+		return host
+	}
+	var hops []string
+	for _, header := range req.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(header, ",")...)
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			break
+		}
+		host = hop.Unmap().String()
+		if !proxies.contains(hop) {
+			break
+		}
+	}
+	return host
+}
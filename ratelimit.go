@@ -0,0 +1,282 @@
+package trapwords
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Limit is a rate written as "<count>/<duration>", e.g. "20/10m": up to
+// count requests in any burst, refilling at count per duration. The
+// zero Limit allows everything.
+type Limit struct {
+	Count int
+	Per   time.Duration
+}
+
+func (l Limit) enabled() bool {
+	return l.Count > 0 && l.Per > 0
+}
+
+func (l Limit) String() string {
+	if !l.enabled() {
+		return "0"
+	}
+	return fmt.Sprintf("%d/%s", l.Count, l.Per)
+}
+
+// Set implements flag.Value.
+func (l *Limit) Set(s string) error {
+	if s == "" || s == "0" {
+		*l = Limit{}
+		return nil
+	}
+	count, per, ok := strings.Cut(s, "/")
+	if !ok {
+		return fmt.Errorf("rate limit %q should look like 20/10m", s)
+	}
+	n, err := strconv.Atoi(count)
+	if err != nil || n < 0 {
+		return fmt.Errorf("rate limit %q has an invalid count", s)
+	}
+	d, err := time.ParseDuration(per)
+	if err != nil || d <= 0 {
+		return fmt.Errorf("rate limit %q has an invalid duration", s)
+	}
+	*l = Limit{Count: n, Per: d}
+	return nil
+}
+
+func (l Limit) MarshalText() ([]byte, error) {
+	return []byte(l.String()), nil
+}
+
+func (l *Limit) UnmarshalText(text []byte) error {
+	return l.Set(string(text))
+}
+
+// RateLimitConfig holds the limits applied to mutating requests.
+type RateLimitConfig struct {
+	// GameCreation limits how many new games each client IP may create.
+	GameCreation Limit `json:"game_creation"`
+	// WordFetch limits how many remote word lists each client IP may
+	// make the server fetch.
+	WordFetch Limit `json:"word_fetch"`
+	// ClientActions limits end turn, guess, next game and host requests
+	// from each client IP, across all games.
+	ClientActions Limit `json:"client_actions"`
+	// GameActions limits end turn, guess, next game and host requests
+	// to each game, across all clients.
+	GameActions Limit `json:"game_actions"`
+	// JoinAttempts limits how many times each client IP may try a
+	// private game's password.
+	JoinAttempts Limit `json:"join_attempts"`
+	// Profiles limits how many profiles each client IP may create.
+	Profiles Limit `json:"profiles"`
+}
+
+// tokenBucket holds up to limit.Count tokens, refilled continuously.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// limiter keeps a token bucket per key.
+type limiter struct {
+	limit Limit
+	clock Clock
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+func newLimiter(limit Limit, clock Clock) *limiter {
+	return &limiter{limit: limit, clock: clock, buckets: make(map[string]*tokenBucket)}
+}
+
+// allow takes a token from key's bucket. If there are none left it
+// returns false and how long until there will be.
+func (l *limiter) allow(key string) (bool, time.Duration) {
+	if !l.limit.enabled() {
+		return true, 0
+	}
+	now := l.clock.Now()
+	perToken := l.limit.Per / time.Duration(l.limit.Count)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: float64(l.limit.Count), last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(float64(l.limit.Count), b.tokens+float64(now.Sub(b.last))/float64(perToken))
+	b.last = now
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) * float64(perToken))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// prune forgets buckets that have refilled completely, since a new
+// bucket would be identical.
+func (l *limiter) prune() {
+	now := l.clock.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for key, b := range l.buckets {
+		if now.Sub(b.last) >= l.limit.Per {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+type rateLimiters struct {
+	gameCreation  *limiter
+	wordFetch     *limiter
+	clientActions *limiter
+	gameActions   *limiter
+	joinAttempts  *limiter
+	profiles      *limiter
+}
+
+func newRateLimiters(cfg RateLimitConfig, clock Clock) *rateLimiters {
+	return &rateLimiters{
+		gameCreation:  newLimiter(cfg.GameCreation, clock),
+		wordFetch:     newLimiter(cfg.WordFetch, clock),
+		clientActions: newLimiter(cfg.ClientActions, clock),
+		gameActions:   newLimiter(cfg.GameActions, clock),
+		joinAttempts:  newLimiter(cfg.JoinAttempts, clock),
+		profiles:      newLimiter(cfg.Profiles, clock),
+	}
+}
+
+func (r *rateLimiters) prune() {
+	r.gameCreation.prune()
+	r.wordFetch.prune()
+	r.clientActions.prune()
+	r.gameActions.prune()
+	r.joinAttempts.prune()
+	r.profiles.prune()
+}
+
+// limitedActions are the game actions that count towards the client
+// and game action limits.
+var limitedActions = map[string]bool{
+	"end-turn":  true,
+	"guess":     true,
+	"next-game": true,
+	"kick":      true,
+	"set-round": true,
+	"settings":  true,
+	"team":      true,
+}
+
+// maxPeekBody bounds how much of a request body rateLimit will buffer
+// to find the game ID.
+const maxPeekBody = 64 << 10
+
+// rateLimit rejects mutating requests over their limits with 429 Too
+// Many Requests. Polling and static assets are never limited. Game
+// creation is limited where games are created, since a game can be
+// created by any request that recreates it from a state ID.
+func (s *Server) rateLimit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		ip := s.clientIP(req)
+
+		type check struct {
+			l    *limiter
+			key  string
+			what string
+		}
+		var checks []check
+
+		// Actions are POSTed to /api/v1/games/<id>/<action>, or to
+		// /<action> with the game ID in the body on the old routes.
+		gameID, action, ok := gameActionPath(req.URL.Path)
+		if !ok && req.Method == "POST" {
+			action = strings.TrimPrefix(req.URL.Path, "/")
+			if limitedActions[action] || action == "join" {
+				gameID = peekGameID(req)
+			}
+		}
+		if req.Method != "POST" {
+			action = ""
+		}
+
+		switch {
+		case req.URL.Path == apiPrefix+"/profiles" && req.Method == "POST":
+			checks = append(checks, check{s.limits.profiles, ip, "profile creation"})
+		case limitedActions[action]:
+			checks = append(checks, check{s.limits.clientActions, ip, "game actions"})
+			if gameID != "" {
+				checks = append(checks, check{s.limits.gameActions, gameID, "actions in this game"})
+			}
+		case action == "join":
+			checks = append(checks, check{s.limits.joinAttempts, ip + " " + gameID, "attempts to join this game"})
+		}
+
+		for _, c := range checks {
+			if !s.allow(rw, req, c.l, c.key, c.what) {
+				return
+			}
+		}
+		next.ServeHTTP(rw, req)
+	})
+}
+
+// allow takes a token from l for key. If there are none left it writes
+// a 429 saying there have been too many requests for what, and returns
+// false.
+func (s *Server) allow(rw http.ResponseWriter, req *http.Request, l *limiter, key, what string) bool {
+	ok, wait := l.allow(key)
+	if ok {
+		return true
+	}
+	seconds := int(math.Ceil(wait.Seconds()))
+	rw.Header().Set("Retry-After", strconv.Itoa(seconds))
+	writeError(rw, http.StatusTooManyRequests, "rate_limited", fmt.Sprintf("Too many requests for %s, try again in %ds", what, seconds))
+	s.logFor(req).Warn("rate limited", "limit", what, "key", key)
+	return false
+}
+
+// allowGameCreation charges the client for creating a game, and for
+// fetching wordsLink if that isn't empty. If either is over its limit
+// it writes a 429 and returns false.
+func (s *Server) allowGameCreation(rw http.ResponseWriter, req *http.Request, wordsLink string) bool {
+	ip := s.clientIP(req)
+	if !s.allow(rw, req, s.limits.gameCreation, ip, "game creation") {
+		return false
+	}
+	return wordsLink == "" || s.allow(rw, req, s.limits.wordFetch, ip, "custom word lists")
+}
+
+// peekBody reads up to maxPeekBody of req's body, leaving the body in
+// place for the handler.
+func peekBody(req *http.Request) []byte {
+	body, err := io.ReadAll(io.LimitReader(req.Body, maxPeekBody))
+	req.Body.Close()
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		return nil
+	}
+	return body
+}
+
+// peekGameID reads the game_id from a JSON request body, leaving the
+// body in place for the handler.
+func peekGameID(req *http.Request) string {
+	var request struct {
+		GameID string `json:"game_id"`
+	}
+	json.Unmarshal(peekBody(req), &request)
+	return request.GameID
+}
@@ -0,0 +1,83 @@
+package trapwords
+
+import "sync"
+
+// gameRegistry maps game IDs to games. Its lock only guards the map
+// itself and is never held while a game is being read or changed; each
+// game has its own lock for that, so a slow request for one game never
+// holds up another.
+type gameRegistry struct {
+	mu      sync.RWMutex
+	entries map[string]*gameEntry
+}
+
+// gameEntry holds a game and the lock guarding it. Starting the next
+// game swaps the Game inside the entry rather than the entry itself, so
+// requests queued on the lock see the new game once they get it.
+type gameEntry struct {
+	mu   sync.Mutex
+	game *Game
+	// removed is set once the game has been deleted, so requests that
+	// were waiting on mu don't save it again.
+	removed bool
+}
+
+func newGameRegistry() *gameRegistry {
+	return &gameRegistry{entries: make(map[string]*gameEntry)}
+}
+
+func (r *gameRegistry) get(id string) (*gameEntry, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	e, ok := r.entries[id]
+	return e, ok
+}
+
+// getOrCreate returns the entry for id, calling create to make its game
+// if there isn't one yet. created reports whether create was used.
+// create runs with the registry locked, so it must be quick.
+func (r *gameRegistry) getOrCreate(id string, create func() *Game) (e *gameEntry, created bool) {
+	if e, ok := r.get(id); ok {
+		return e, false
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	// Someone may have beaten us to it between the two locks.
+	if e, ok := r.entries[id]; ok {
+		return e, false
+	}
+	e = &gameEntry{game: create()}
+	r.entries[id] = e
+	return e, true
+}
+
+// remove deletes id from the registry, but only if it still maps to e,
+// so a game recreated in the meantime isn't lost.
+func (r *gameRegistry) remove(id string, e *gameEntry) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.entries[id] != e {
+		return false
+	}
+	delete(r.entries, id)
+	return true
+}
+
+// snapshot returns every entry at the time of the call. The entries
+// must still be locked before their games are used.
+func (r *gameRegistry) snapshot() map[string]*gameEntry {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	entries := make(map[string]*gameEntry, len(r.entries))
+	for id, e := range r.entries {
+		entries[id] = e
+	}
+	return entries
+}
+
+func (r *gameRegistry) len() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.entries)
+}
@@ -0,0 +1,47 @@
+package trapwords
+
+// Room is the place a game is played, which outlasts the game: its ID,
+// who is in it, the words it deals from and how the host has set it up.
+// The games played in a room are one after another, each a Game that
+// shares the room, so starting the next game keeps everyone seated.
+type Room struct {
+	ID string `json:"-"`
+	// Revision goes up by one every time the room's game changes,
+	// including across next games. Clients send back the revision they
+	// saw when they act, so stale actions can be refused.
+	Revision int64    `json:"revision"`
+	Words    []string `json:"-"`
+	// WordSource is the link Words were fetched from, or
+	// defaultWordSource.
+	WordSource string `json:"-"`
+	// Password is set for private rooms created with a password.
+	// Private games recreated from their state ID have none, so
+	// only existing sessions can play them.
+	Password *gamePassword `json:"-"`
+	// HostID is the player ID of the room's host, who alone may
+	// start the next game, change settings, kick players and force
+	// the round. Players holds everyone currently in the room, and
+	// Kicked the players the host has removed.
+	HostID  string             `json:"host_id"`
+	Players map[string]*Player `json:"-"`
+	Kicked  map[string]bool    `json:"-"`
+	// Match is the series of games being played in the room, if any.
+	Match *Match `json:"match,omitempty"`
+}
+
+// nextGame starts the room's next game with state, telling the time
+// with clock. It's up to the caller to move the match on.
+func (r *Room) nextGame(state GameState, clock Clock) *Game {
+	return newGame(r, state, clock)
+}
+
+// swapTeams moves everyone on red to blue and everyone on blue to red.
+// The match swaps with them, so it stays with the players.
+func (r *Room) swapTeams() {
+	for _, p := range r.Players {
+		p.Team = p.Team.Other()
+	}
+	if r.Match != nil {
+		r.Match.swap()
+	}
+}
@@ -1,14 +1,23 @@
 package trapwords
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
+	"io"
+	"io/fs"
 	"io/ioutil"
+	"log/slog"
+	"math/rand"
 	"net/http"
+	"net/url"
 	"path"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/jbowens/assets"
@@ -17,52 +26,153 @@ import (
 
 type Server struct {
 	Server http.Server
-
-	tpl    *template.Template
-	jslib  assets.Bundle
-	js     assets.Bundle
-	css    assets.Bundle
-	other  assets.Bundle
-
-	gameIDWords []string
-
-	mu         sync.Mutex
-	games      map[string]*Game
-	words	   []string
-	mux        *http.ServeMux
+	Config Config
+	// Logger receives all of the server's logs. If nil, slog.Default
+	// is used.
+	Logger *slog.Logger
+	// Clock tells the server and its games the time. If nil, the
+	// system clock is used.
+	Clock Clock
+	// Rand is the source of game seeds and made up game IDs. If nil,
+	// one seeded from the time is used.
+	Rand rand.Source
+
+	assetFS fs.FS
+	tpl     *template.Template
+	jslib   assets.Bundle
+	js      assets.Bundle
+	css     assets.Bundle
+	other   assets.Bundle
+
+	gameIDs    *gameIDGenerator
+	store      Store
+	sessionKey []byte
+
+	games    *gameRegistry
+	records  recordArchive
+	profiles *profileRegistry
+	words    []string
+	mux      *http.ServeMux
+	metrics  *serverMetrics
+	limits   *rateLimiters
+
+	rnd     *rand.Rand
+	rndOnce sync.Once
+
+	shuttingDown atomic.Bool
 }
 
-func (s *Server) getGame(gameID, stateID string) (*Game, bool) {
-	g, ok := s.games[gameID]
-	if ok {
-		return g, ok
+// getGame returns the entry for gameID, recreating the game from
+// stateID if the server doesn't know about it, e.g. after a restart.
+// Recreating a game counts towards the client's game creation limit.
+// On failure it writes a 404 or 429 and returns nil.
+func (s *Server) getGame(rw http.ResponseWriter, req *http.Request, gameID, stateID string) *gameEntry {
+	if e, ok := s.games.get(gameID); ok {
+		return e
 	}
 	state, ok := decodeGameState(stateID)
 	if !ok {
-		return nil, false
+		writeError(rw, http.StatusNotFound, "game_not_found", "No such game")
+		return nil
+	}
+	if !s.allowGameCreation(rw, req, "") {
+		return nil
+	}
+	e, created := s.games.getOrCreate(gameID, func() *Game {
+		g := NewGame(gameID, s.words, state, s.clock())
+		g.WordSource = defaultWordSource
+		return g
+	})
+	if created {
+		s.metrics.gamesCreated.inc("state")
+		e.mu.Lock()
+		s.gameChanged(e)
+		e.mu.Unlock()
+		s.evictGames()
+	}
+	return e
+}
+
+// gameChanged marks e's game as active, bumps its revision and persists
+// it, unless it has been deleted in the meantime. The caller holds e's
+// lock. Failures are logged rather than returned: the in-memory copy is
+// still authoritative and the game remains playable.
+func (s *Server) gameChanged(e *gameEntry) {
+	g := e.game
+	g.LastActivity = s.now()
+	g.Revision++
+	s.archive(g)
+	if e.removed {
+		return
+	}
+	if err := s.store.SaveGame(g); err != nil {
+		s.logger().Error("failed to save game", "game_id", g.ID, "err", err)
 	}
-	g = newGame(gameID, s.words, state)
-	s.games[gameID] = g
-	return g, true
 }
 
-func (s *Server) getWordsFromLink(rw http.ResponseWriter, wordsLink string) ([]string, error) {
+// deleteGame removes the game in e, reporting whether it was still
+// registered under id.
+func (s *Server) deleteGame(id string, e *gameEntry) bool {
+	if !s.games.remove(id, e) {
+		return false
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.removed = true
+	if err := s.store.DeleteGame(id); err != nil {
+		s.logger().Error("failed to delete game", "game_id", id, "err", err)
+	}
+	return true
+}
+
+func (s *Server) getWordsFromLink(req *http.Request, wordsLink string) ([]string, error) {
 	if wordsLink == "" {
 		// No link was given, use the server's default words.
 		return s.words, nil
 	}
 
-	fmt.Printf("Trying to use custom words from %s\n", wordsLink)
-	rs, err := http.Get(wordsLink)
+	log := s.logFor(req).With("link", wordsLink)
+	log.Info("fetching custom words")
+	start := time.Now()
+	words, err := fetchWords(wordsLink)
+	s.metrics.wordListFetchTime.since(start)
+	if err != nil {
+		log.Warn("could not fetch custom words", "err", err)
+		s.metrics.wordListFetches.inc("failure")
+		return nil, err
+	}
+	s.metrics.wordListFetches.inc("success")
+	log.Debug("fetched custom words", "count", len(words))
+	return words, nil
+}
+
+// wordsClient fetches custom word lists. Links come from anyone who
+// creates a game, so don't let a slow server tie up a request forever.
+var wordsClient = &http.Client{Timeout: 10 * time.Second}
+
+// maxWordsSize is the most of a custom word list that will be read.
+const maxWordsSize = 1 << 20
+
+func fetchWords(wordsLink string) ([]string, error) {
+	u, err := url.Parse(wordsLink)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported scheme %q", u.Scheme)
+	}
+
+	rs, err := wordsClient.Get(u.String())
 	if err != nil {
-		http.Error(rw, "Problem with provided link", 400)
 		return nil, err
 	}
 	defer rs.Body.Close()
+	if rs.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("got status %s", rs.Status)
+	}
 
-	bodyBytes, err := ioutil.ReadAll(rs.Body)
+	bodyBytes, err := ioutil.ReadAll(io.LimitReader(rs.Body, maxWordsSize))
 	if err != nil {
-		http.Error(rw, "Problem with provided link", 400)
 		return nil, err
 	}
 	bodyString := string(bodyBytes)
@@ -73,240 +183,649 @@ func (s *Server) getWordsFromLink(rw http.ResponseWriter, wordsLink string) ([]s
 	validWords := make([]string, 0, len(words))
 	for _, word := range words {
 		if len(strings.TrimSpace(word)) > 0 {
-	        validWords = append(validWords, word)
-	    }
+			validWords = append(validWords, word)
+		}
 	}
 
 	return validWords, nil
 }
 
-// GET /game/<id>
-func (s *Server) handleRetrieveGame(rw http.ResponseWriter, req *http.Request) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+// GET /api/v1/games/<id>
+//
+// The optional state_id query parameter recreates the game if the
+// server has lost it, e.g. after a restart.
+func (s *Server) handleGetGame(rw http.ResponseWriter, req *http.Request) {
+	gameID := req.PathValue("id")
+	setGameID(req, gameID)
+	e := s.getGame(rw, req, gameID, req.FormValue("state_id"))
+	if e == nil {
+		return
+	}
+	s.metrics.pollers.seen(gameID, s.clientIP(req))
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if sess, ok := s.reader(rw, req, e); ok {
+		writeGame(rw, e.game, sess)
+	}
+}
 
-	err := req.ParseForm()
-	if err != nil {
-		http.Error(rw, "Error decoding query string", 400)
+// POST /api/v1/games
+//
+// Creates a game, making the client its host. Without an id, one is
+// made up.
+func (s *Server) handleCreateGame(rw http.ResponseWriter, req *http.Request) {
+	var request CreateGameRequest
+	if !decodeRequest(rw, req, &request) {
+		return
+	}
+	if !checkMatchLength(rw, request.MatchLength) {
 		return
 	}
+	if request.ID == "" {
+		request.ID = s.gameIDs.Suggest()
+	}
 
+	if e, created := s.createGame(rw, req, request.ID, request.WordsLink, request.Password, request.MatchLength); e != nil && !created {
+		writeError(rw, http.StatusConflict, "game_exists", "A game with that ID already exists")
+	}
+}
+
+// GET or POST /game/<id>, and GET /game/<id>/export
+//
+// Deprecated: fetches a game, creating it if it doesn't exist. Takes
+// form values rather than JSON.
+func (s *Server) handleRetrieveGame(rw http.ResponseWriter, req *http.Request) {
+	rw.Header().Set("Deprecation", "true")
+	if p, ok := strings.CutSuffix(req.URL.Path, "/export"); ok {
+		req.SetPathValue("id", path.Base(p))
+		s.handleExport(rw, req)
+		return
+	}
 	gameID := path.Base(req.URL.Path)
-	g, ok := s.getGame(gameID, req.Form.Get("state_id"))
-	if ok {
-		writeGame(rw, g)
+	req.SetPathValue("id", gameID)
+	if err := req.ParseForm(); err != nil {
+		writeError(rw, http.StatusBadRequest, "bad_request", "Error decoding form")
+		return
+	}
+	_, exists := s.games.get(gameID)
+	if _, recreatable := decodeGameState(req.Form.Get("state_id")); exists || recreatable {
+		s.handleGetGame(rw, req)
 		return
 	}
 
-	words, err := s.getWordsFromLink(rw, req.Form.Get("newGameWordsLink"))
+	// If someone else created the game in the meantime, join theirs.
+	if e, created := s.createGame(rw, req, gameID, req.Form.Get("newGameWordsLink"), req.Form.Get("password"), 0); e != nil && !created {
+		s.handleGetGame(rw, req)
+	}
+}
+
+// createGame creates the game gameID with words from wordsLink, or the
+// default words, as the first game of a match of matchLength games if
+// that isn't 0, and makes the client its host. If the game was
+// created it writes it with 201 Created; if it already existed it
+// returns its entry without writing anything. On failure it writes
+// the error and returns nil.
+func (s *Server) createGame(rw http.ResponseWriter, req *http.Request, gameID, wordsLink, plainPassword string, matchLength int) (e *gameEntry, created bool) {
+	setGameID(req, gameID)
+	if e, ok := s.games.get(gameID); ok {
+		return e, false
+	}
+	if !s.allowGameCreation(rw, req, wordsLink) {
+		return nil, false
+	}
+
+	// Fetch custom words without holding any lock; the link may be slow.
+	words, err := s.getWordsFromLink(req, wordsLink)
 	if err != nil {
-		fmt.Printf("Could not load in custom words\n")
-		http.Error(rw, "Unknown error encountered with custom words", 400)
-		return
+		writeError(rw, http.StatusBadRequest, "bad_words_link", "Problem with provided link: "+err.Error())
+		return nil, false
 	}
 
-	fmt.Printf("%v", words)
+	// Hashing is deliberately slow, so do that outside the lock too.
+	var password *gamePassword
+	if plainPassword != "" {
+		password, err = hashPassword(plainPassword)
+		if err != nil {
+			writeError(rw, http.StatusInternalServerError, "internal", "Unable to set password")
+			return nil, false
+		}
+	}
 
+	e, created = s.games.getOrCreate(gameID, func() *Game {
+		state := randomState(s.random())
+		state.Private = password != nil
+		state.RoomNonce = s.random().Int63()
+		g := NewGame(gameID, words, state, s.clock())
+		g.Password = password
+		g.WordSource = defaultWordSource
+		if wordsLink != "" {
+			g.WordSource = wordsLink
+		}
+		if matchLength > 0 {
+			g.Match = newMatch(matchLength, s.random())
+		}
+		return g
+	})
+	if !created {
+		return e, false
+	}
 
-	g = newGame(gameID, words, randomState())
-	s.games[gameID] = g
-	writeGame(rw, g)
+	e.mu.Lock()
+	source := "default"
+	if wordsLink != "" {
+		source = "link"
+	}
+	s.metrics.gamesCreated.inc(source)
+	s.gameIDs.Release(gameID)
+	// Whoever creates a game hosts it.
+	sess := s.startSession(rw, req, e.game)
+	e.game.touch(sess.PlayerID, s.now())
+	s.linkProfile(req, e.game, sess.PlayerID)
+	s.gameChanged(e)
+	writeGameStatus(rw, http.StatusCreated, e.game, sess)
+	e.mu.Unlock()
+
+	// Eviction locks every game, so it must wait until ours is unlocked.
+	s.evictGames()
+	return e, true
 }
 
-// POST /guess
-func (s *Server) handleGuess(rw http.ResponseWriter, req *http.Request) {
-	var request struct {
-		GameID  string `json:"game_id"`
-		StateID string `json:"state_id"`
-		Index   int    `json:"index"`
+// lockGame finds and locks the game named in req's path, recreating it
+// from stateID if need be. On failure it writes the error and returns
+// nil.
+func (s *Server) lockGame(rw http.ResponseWriter, req *http.Request, stateID string) *gameEntry {
+	gameID := req.PathValue("id")
+	setGameID(req, gameID)
+	e := s.getGame(rw, req, gameID, stateID)
+	if e == nil {
+		return nil
 	}
+	e.mu.Lock()
+	return e
+}
 
-	decoder := json.NewDecoder(req.Body)
-	if err := decoder.Decode(&request); err != nil {
-		http.Error(rw, "Error decoding", 400)
+// POST /api/v1/games/<id>/guess
+func (s *Server) handleGuess(rw http.ResponseWriter, req *http.Request) {
+	var request GuessRequest
+	if !decodeRequest(rw, req, &request) {
 		return
 	}
 
-	s.mu.Lock()
-	defer s.mu.Unlock()
-
-	g, ok := s.getGame(request.GameID, request.StateID)
-	if !ok {
-		http.Error(rw, "No such game", 404)
+	e := s.lockGame(rw, req, request.StateID)
+	if e == nil {
 		return
 	}
+	defer e.mu.Unlock()
 
-	if err := g.Guess(request.Index); err != nil {
-		http.Error(rw, err.Error(), 400)
+	g := e.game
+	sess, ok := s.player(rw, req, e)
+	if !ok || !requirePlayer(rw, g, sess) || !checkRevision(rw, g, request.Revision) {
 		return
 	}
-	writeGame(rw, g)
+	from := g.Phase()
+	if err := g.Guess(g.Players[sess.PlayerID], request.Index); err != nil {
+		writeActionError(rw, err)
+		return
+	}
+	s.recordProgress(g, from)
+	if g.WinningTeam != nil {
+		s.metrics.gamesCompleted.inc(g.WinningTeam.String())
+	}
+	s.gameChanged(e)
+	writeGame(rw, g, sess)
 }
 
-// POST /end-turn
+// POST /api/v1/games/<id>/end-turn
 func (s *Server) handleEndTurn(rw http.ResponseWriter, req *http.Request) {
-	var request struct {
-		GameID  string `json:"game_id"`
-		StateID string `json:"state_id"`
-	}
+	defer s.metrics.endTurnLatency.since(time.Now())
 
-	decoder := json.NewDecoder(req.Body)
-	if err := decoder.Decode(&request); err != nil {
-		http.Error(rw, "Error decoding", 400)
+	var request EndTurnRequest
+	if !decodeRequest(rw, req, &request) {
 		return
 	}
 
-	s.mu.Lock()
-	defer s.mu.Unlock()
-
-	g, ok := s.getGame(request.GameID, request.StateID)
-	if !ok {
-		http.Error(rw, "No such game", 404)
+	e := s.lockGame(rw, req, request.StateID)
+	if e == nil {
 		return
 	}
+	defer e.mu.Unlock()
 
-	if err := g.NextTurn(); err != nil {
-		http.Error(rw, err.Error(), 400)
+	g := e.game
+	sess, ok := s.player(rw, req, e)
+	if !ok || !requirePlayer(rw, g, sess) || !checkRevision(rw, g, request.Revision) {
+		return
+	}
+	from := g.Phase()
+	if err := g.NextTurn(g.Players[sess.PlayerID]); err != nil {
+		writeActionError(rw, err)
 		return
 	}
-	writeGame(rw, g)
+	s.recordProgress(g, from)
+	s.gameChanged(e)
+	writeGame(rw, g, sess)
 }
 
+// POST /api/v1/games/<id>/next-game
 func (s *Server) handleNextGame(rw http.ResponseWriter, req *http.Request) {
-	var request struct {
-		GameID string `json:"game_id"`
+	var request NextGameRequest
+	if !decodeRequest(rw, req, &request) {
+		return
 	}
 
-	decoder := json.NewDecoder(req.Body)
-	if err := decoder.Decode(&request); err != nil {
-		http.Error(rw, "Error decoding", 400)
+	e, sess, ok := s.hostRequest(rw, req)
+	if !ok {
 		return
 	}
+	defer e.mu.Unlock()
+	if !checkRevision(rw, e.game, request.Revision) {
+		return
+	}
+
+	// Start the room's next game with a random state. Everyone stays
+	// seated, on the other side if the host asked to swap, and the match
+	// carries on, or a rematch starts if it's over.
+	room := e.game.Room
+	state := randomState(s.random())
+	state.Private = e.game.Private
+	state.RoomNonce = e.game.RoomNonce
+	if request.SwapTeams {
+		room.swapTeams()
+	}
+	room.Match = room.Match.next(s.random())
+	e.game = room.nextGame(state, s.clock())
+	s.metrics.gamesCreated.inc("next_game")
+	s.gameChanged(e)
+	writeGame(rw, e.game, sess)
+}
 
-	s.mu.Lock()
-	defer s.mu.Unlock()
+// POST /api/v1/games/<id>/team
+func (s *Server) handleTeam(rw http.ResponseWriter, req *http.Request) {
+	var request TeamRequest
+	if !decodeRequest(rw, req, &request) {
+		return
+	}
 
-	// Find the existing game so we can fetch the words it uses.
-	g, exists := s.games[request.GameID]
+	e := s.lockGame(rw, req, "")
+	if e == nil {
+		return
+	}
+	defer e.mu.Unlock()
 
-	if !exists {
-		http.Error(rw, "Invalid game", 404)
+	g := e.game
+	sess, ok := s.player(rw, req, e)
+	if !ok || !requirePlayer(rw, g, sess) {
+		return
+	}
+	if err := g.setTeam(sess.PlayerID, request.Team); err != nil {
+		writeError(rw, http.StatusBadRequest, "invalid_action", err.Error())
 		return
 	}
+	s.gameChanged(e)
+	writeGame(rw, g, sess)
+}
 
-	// Create a new game with the same ID and source words from the past game but with a random state.
-	g = newGame(request.GameID, g.Words, randomState())
-	s.games[request.GameID] = g
-	writeGame(rw, g)
+// checkRevision writes a 409 and returns false if revision, the
+// revision of g the client last saw, is out of date. This stops two
+// players who click at the same moment from both acting. Requests
+// that don't say which revision they saw aren't checked.
+func checkRevision(rw http.ResponseWriter, g *Game, revision *int64) bool {
+	if revision == nil || *revision == g.Revision {
+		return true
+	}
+	writeError(rw, http.StatusConflict, "stale_revision", "The game has changed since you last saw it")
+	return false
 }
 
-type statsResponse struct {
-	InProgress int `json:"games_in_progress"`
+// writeActionError responds to a game action that failed with err.
+// Actions the player isn't allowed to take get 403 Forbidden, and
+// anything else is a bad request.
+func writeActionError(rw http.ResponseWriter, err error) {
+	var forbidden *ForbiddenError
+	if errors.As(err, &forbidden) {
+		writeError(rw, http.StatusForbidden, forbidden.Code, forbidden.Reason)
+		return
+	}
+	writeError(rw, http.StatusBadRequest, "invalid_action", err.Error())
 }
 
-func (s *Server) handleStats(rw http.ResponseWriter, req *http.Request) {
-	var inProgress int
+// recordProgress counts a phase transition if g has left phase from.
+func (s *Server) recordProgress(g *Game, from Phase) {
+	if to := g.Phase(); to != from {
+		s.metrics.phaseTransitions.inc(string(from), string(to))
+	}
+}
 
-	s.mu.Lock()
-	defer s.mu.Unlock()
+func (s *Server) handleStats(rw http.ResponseWriter, req *http.Request) {
+	writeJSON(rw, StatsResponse{int(s.countGames()["in_progress"])})
+}
 
-	for _, g := range s.games {
-		if g.WinningTeam == nil {
-			inProgress++
+// countGames returns how many games are in progress and completed.
+func (s *Server) countGames() map[string]float64 {
+	counts := map[string]float64{"in_progress": 0, "completed": 0}
+	for _, e := range s.games.snapshot() {
+		e.mu.Lock()
+		if e.game.WinningTeam == nil {
+			counts["in_progress"]++
+		} else {
+			counts["completed"]++
 		}
+		e.mu.Unlock()
 	}
-	writeJSON(rw, statsResponse{inProgress})
+	return counts
 }
 
-func (s *Server) cleanupOldGames() {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	for id, g := range s.games {
-		if g.WinningTeam != nil && g.CreatedAt.Add(12*time.Hour).Before(time.Now()) {
-			delete(s.games, id)
-			fmt.Printf("Removed completed game %s\n", id)
+// cleanupOldGames removes games that have been idle for too long, then
+// evicts the least recently active games if there are still more than
+// the configured maximum. It returns how many games it removed.
+func (s *Server) cleanupOldGames() int {
+	var removed int
+	now := s.now()
+	for id, e := range s.games.snapshot() {
+		e.mu.Lock()
+		g := e.game
+		idle := now.Sub(g.lastActive())
+		completed := g.WinningTeam != nil && idle > s.Config.CompletedGameTTL.Duration
+		expired := idle > s.Config.GameTTL.Duration
+		e.mu.Unlock()
+
+		if completed && s.deleteGame(id, e) {
+			removed++
+			s.metrics.gamesRemoved.inc("completed")
+			s.logger().Info("removed completed game", "game_id", id, "idle", idle)
 			continue
 		}
-		if g.CreatedAt.Add(24 * time.Hour).Before(time.Now()) {
-			delete(s.games, id)
-			fmt.Printf("Removed expired game %s\n", id)
+		if expired && s.deleteGame(id, e) {
+			removed++
+			s.metrics.gamesRemoved.inc("expired")
+			s.logger().Info("removed expired game", "game_id", id, "idle", idle)
 			continue
 		}
 	}
+	return removed + s.evictGames()
 }
 
-func (s *Server) Start() error {
-	gameIDs, err := dictionary.Load("assets/game-id-words.txt")
-	if err != nil {
+// evictGames removes the least recently active games until there are
+// no more than MaxGames, and returns how many it removed.
+func (s *Server) evictGames() int {
+	max := s.Config.MaxGames
+	if max <= 0 || s.games.len() <= max {
+		return 0
+	}
+
+	type candidate struct {
+		id         string
+		entry      *gameEntry
+		lastActive time.Time
+	}
+	var candidates []candidate
+	for id, e := range s.games.snapshot() {
+		e.mu.Lock()
+		candidates = append(candidates, candidate{id, e, e.game.lastActive()})
+		e.mu.Unlock()
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].lastActive.Before(candidates[j].lastActive)
+	})
+
+	var removed int
+	for _, c := range candidates {
+		if s.games.len() <= max {
+			break
+		}
+		if s.deleteGame(c.id, c.entry) {
+			removed++
+			s.metrics.gamesRemoved.inc("evicted")
+			s.logger().Info("evicted game", "game_id", c.id, "last_active", c.lastActive)
+		}
+	}
+	return removed
+}
+
+// Start loads the server's assets and serves HTTP until ctx is
+// cancelled, at which point it stops accepting connections, waits for
+// in-flight requests to finish and flushes every game to the store.
+func (s *Server) Start(ctx context.Context) error {
+	if err := s.Init(); err != nil {
 		return err
 	}
 
-	words, err := dictionary.Load("assets/default-words.txt")
-	if err != nil {
+	cleanupCtx, stopCleanup := context.WithCancel(ctx)
+	cleanupDone := make(chan struct{})
+	go func() {
+		defer close(cleanupDone)
+		s.cleanupLoop(cleanupCtx)
+	}()
+	defer func() {
+		stopCleanup()
+		<-cleanupDone
+	}()
+
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- s.Server.ListenAndServe()
+	}()
+	s.logger().Info("server running", "addr", s.Server.Addr)
+
+	select {
+	case err := <-serveErr:
 		return err
+	case <-ctx.Done():
 	}
 
-	s.tpl, err = template.New("index").Parse(tpl)
+	// Fail readiness checks first, and give load balancers a moment to
+	// notice before we stop accepting connections.
+	s.shuttingDown.Store(true)
+	s.logger().Info("shutting down", "delay", s.Config.ShutdownDelay.Duration)
+	time.Sleep(s.Config.ShutdownDelay.Duration)
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), s.Config.ShutdownTimeout.Duration)
+	defer cancel()
+	err := s.Server.Shutdown(shutdownCtx)
 	if err != nil {
+		s.logger().Error("failed to drain connections", "err", err)
+	}
+
+	// Flush even if draining timed out; the games are what matter.
+	if flushErr := s.flushGames(); flushErr != nil {
+		return flushErr
+	}
+	return err
+}
+
+// Init loads the server's assets, words and stored games and sets
+// s.Server.Handler, without listening or cleaning up old games. Start
+// calls it; call it directly to serve the handler some other way, as
+// the client's tests do.
+func (s *Server) Init() error {
+	s.Config.setDefaults()
+	if err := s.Config.Validate(); err != nil {
 		return err
 	}
-	s.jslib, err = assets.Development("assets/jslib")
+	if s.Server.Addr == "" {
+		s.Server.Addr = s.Config.ListenAddr
+	}
+
+	assetFS, err := s.Config.assetFS()
 	if err != nil {
 		return err
 	}
-	s.js, err = assets.Development("assets/javascript")
+	wordFS, err := s.Config.wordPackFS()
 	if err != nil {
 		return err
 	}
-	s.css, err = assets.Development("assets/stylesheets")
+
+	gameIDs, err := loadDictionary(wordFS, "game-id-words.txt")
 	if err != nil {
 		return err
 	}
-	s.other, err = assets.Development("assets/other")
+
+	words, err := loadDictionary(wordFS, "default-words.txt")
 	if err != nil {
 		return err
 	}
 
-	s.mux = http.NewServeMux()
+	s.store, err = newStore(s.Config.Storage)
+	if err != nil {
+		return err
+	}
 
-	s.mux.HandleFunc("/stats", s.handleStats)
-	s.mux.HandleFunc("/next-game", s.handleNextGame)
-	s.mux.HandleFunc("/end-turn", s.handleEndTurn)
-	s.mux.HandleFunc("/guess", s.handleGuess)
-	s.mux.HandleFunc("/game/", s.handleRetrieveGame)
+	s.sessionKey, err = s.Config.sessionKey()
+	if err != nil {
+		return err
+	}
+	if s.Config.SessionSecret == "" {
+		s.logger().Warn("no session secret configured, players of private games will have to rejoin after a restart")
+	}
 
-	s.mux.Handle("/js/lib/", http.StripPrefix("/js/lib/", s.jslib))
-	s.mux.Handle("/js/", http.StripPrefix("/js/", s.js))
-	s.mux.Handle("/css/", http.StripPrefix("/css/", s.css))
-	s.mux.Handle("/other/", http.StripPrefix("/other/", s.other))
-	s.mux.HandleFunc("/", s.handleIndex)
+	if err := s.loadAssets(assetFS); err != nil {
+		return err
+	}
+	s.mux = http.NewServeMux()
+	s.registerRoutes(s.mux)
 
 	gameIDs = dictionary.Filter(gameIDs, func(s string) bool { return len(s) > 3 })
-	s.gameIDWords = gameIDs.Words()
+	s.gameIDs = newGameIDGenerator(gameIDs.Words(), s.clock(), s.random(), func(id string) bool {
+		_, ok := s.games.get(id)
+		return ok
+	})
 
 	words = dictionary.Filter(words, func(s string) bool { return len(s) > 4 })
 	s.words = words.Words()
 
-	s.games = make(map[string]*Game)
-	s.Server.Handler = s.mux
+	s.games = newGameRegistry()
+	s.profiles = newProfileRegistry()
+	s.metrics = newServerMetrics(s.clock())
+	s.metrics.register(&gaugeFunc{
+		name:   "trapwords_games",
+		help:   "Games currently held by the server, by state.",
+		labels: []string{"state"},
+		fn:     s.countGames,
+	})
+	stored, err := s.store.LoadGames()
+	if err != nil {
+		return err
+	}
+	for _, g := range stored {
+		g := g
+		g.clock = s.clock()
+		if g.WordSource == defaultWordSource {
+			g.Words = s.words
+		}
+		s.games.getOrCreate(g.ID, func() *Game { return g })
+	}
+	if len(stored) > 0 {
+		s.logger().Info("restored games from storage", "count", len(stored))
+	}
+	records, err := s.store.LoadRecords()
+	if err != nil {
+		return err
+	}
+	s.records.add(records...)
+	profiles, err := s.store.LoadProfiles()
+	if err != nil {
+		return err
+	}
+	for _, p := range profiles {
+		s.profiles.add(p)
+	}
+	s.limits = newRateLimiters(s.Config.RateLimits, s.clock())
+	s.Server.Handler = s.handler()
+	return nil
+}
+
+// handler wraps the server's routes in the middleware every request
+// goes through.
+func (s *Server) handler() http.Handler {
+	return s.logRequests(s.rateLimit(s.mux))
+}
 
-	go func() {
-		for range time.Tick(10 * time.Minute) {
+// registerRoutes adds everything the server serves to mux.
+func (s *Server) registerRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("/metrics", s.handleMetrics)
+	mux.HandleFunc("/healthz", s.handleHealthz)
+	mux.HandleFunc("/readyz", s.handleReadyz)
+	mux.Handle("/admin/", s.requireAdmin(http.HandlerFunc(s.handleAdmin)))
+	s.registerAPI(mux)
+
+	mux.Handle("/js/lib/", http.StripPrefix("/js/lib/", s.jslib))
+	mux.Handle("/js/", http.StripPrefix("/js/", s.js))
+	mux.Handle("/css/", http.StripPrefix("/css/", s.css))
+	mux.Handle("/other/", http.StripPrefix("/other/", s.other))
+	mux.HandleFunc("/", s.handleIndex)
+}
+
+func (s *Server) cleanupLoop(ctx context.Context) {
+	ticker := time.NewTicker(s.Config.CleanupInterval.Duration)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
 			s.cleanupOldGames()
+			s.limits.prune()
 		}
-	}()
-	fmt.Printf("Server running!\n")
-	return s.Server.ListenAndServe()
+	}
 }
 
-func writeGame(rw http.ResponseWriter, g *Game) {
-	writeJSON(rw, struct {
-		*Game
-		StateID string `json:"state_id"`
-	}{g, g.GameState.ID()})
+// flushGames writes every game to the store.
+func (s *Server) flushGames() error {
+	entries := s.games.snapshot()
+
+	var failed int
+	for _, e := range entries {
+		e.mu.Lock()
+		err := s.store.SaveGame(e.game)
+		if err != nil {
+			s.logger().Error("failed to save game", "game_id", e.game.ID, "err", err)
+			failed++
+		}
+		e.mu.Unlock()
+	}
+	if failed > 0 {
+		return fmt.Errorf("failed to save %d of %d games", failed, len(entries))
+	}
+	s.logger().Info("saved games", "count", len(entries))
+	return nil
+}
+
+// writeGame writes g as seen by the player with session sess.
+func writeGame(rw http.ResponseWriter, g *Game, sess session) {
+	writeGameStatus(rw, http.StatusOK, g, sess)
+}
+
+func writeGameStatus(rw http.ResponseWriter, status int, g *Game, sess session) {
+	now := g.now()
+	resp := GameResponse{
+		Game:       g,
+		StateID:    g.GameState.ID(),
+		PlayerID:   sess.PlayerID,
+		Players:    g.playerList(now),
+		Spectators: g.spectators(now),
+	}
+	if p, ok := g.Players[sess.PlayerID]; ok {
+		resp.Team = p.Team
+		resp.Spectator = p.Spectator
+	}
+	if resp.Spectator || sess.PlayerID == "" {
+		// Spectators, and anyone who hasn't joined, see a copy of the
+		// game with the words still to be guessed hidden. The words are
+		// dealt from the seed, so that and the state ID, which holds
+		// it, are left out too.
+		view := *g
+		view.RoundWords = g.spectatorWords()
+		view.Seed = 0
+		resp.Game = &view
+		resp.StateID = ""
+	}
+	writeJSONStatus(rw, status, resp)
 }
 
 func writeJSON(rw http.ResponseWriter, resp interface{}) {
+	writeJSONStatus(rw, http.StatusOK, resp)
+}
+
+func writeJSONStatus(rw http.ResponseWriter, status int, resp interface{}) {
 	j, err := json.Marshal(resp)
 	if err != nil {
 		http.Error(rw, "unable to marshal response: "+err.Error(), 500)
@@ -314,5 +833,6 @@ func writeJSON(rw http.ResponseWriter, resp interface{}) {
 	}
 
 	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(status)
 	rw.Write(j)
 }
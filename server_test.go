@@ -0,0 +1,892 @@
+package trapwords
+
+import (
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeClock is a Clock that only moves when told to.
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func newTestServer() *Server {
+	s := &Server{
+		Config:   DefaultConfig(),
+		games:    newGameRegistry(),
+		profiles: newProfileRegistry(),
+		store:    memoryStore{},
+		mux:      http.NewServeMux(),
+		Clock:    &fakeClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)},
+		Rand:     rand.NewSource(1),
+	}
+	s.metrics = newServerMetrics(s.clock())
+	s.limits = newRateLimiters(RateLimitConfig{}, s.clock())
+	s.registerAPI(s.mux)
+	for i := 0; i < 50; i++ {
+		s.words = append(s.words, fmt.Sprintf("WORD%d", i))
+	}
+	s.gameIDs = newGameIDGenerator([]string{"apple", "banana", "cherry"}, s.clock(), s.random(), func(id string) bool {
+		_, ok := s.games.get(id)
+		return ok
+	})
+	return s
+}
+
+func do(handler http.Handler, method, target, body string, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	for _, c := range cookies {
+		req.AddCookie(c)
+	}
+	handler.ServeHTTP(rec, req)
+	return rec
+}
+
+// TestConcurrentGames hammers many games at once. It's mostly useful
+// under the race detector (go test -race), but also checks that no
+// turns are lost when several clients end turns in the same game.
+func TestConcurrentGames(t *testing.T) {
+	s := newTestServer()
+
+	const (
+		games          = 20
+		clientsPerGame = 8
+		turnsPerClient = 25
+		turnsPerGame   = clientsPerGame * turnsPerClient
+	)
+
+	// ended counts the turns each game's clients have ended. Clients
+	// may end a few more than turnsPerGame between them, but every one
+	// must be counted by the game.
+	var ended [games]atomic.Int64
+
+	var wg sync.WaitGroup
+	for i := 0; i < games; i++ {
+		id := fmt.Sprintf("game%d", i)
+		ended := &ended[i]
+		if rec := do(s.mux, "POST", "/api/v1/games", fmt.Sprintf(`{"id": %q}`, id)); rec.Code != 201 {
+			t.Fatalf("create %s: %d %s", id, rec.Code, rec.Body)
+		}
+		for c := 0; c < clientsPerGame; c++ {
+			team := []string{"red", "blue"}[c%2]
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				rec := do(s.mux, "POST", "/api/v1/games/"+id+"/join", "")
+				if rec.Code != 200 {
+					t.Errorf("join %s: %d %s", id, rec.Code, rec.Body)
+					return
+				}
+				session := rec.Result().Cookies()
+				body := fmt.Sprintf(`{"team": %q}`, team)
+				if rec := do(s.mux, "POST", "/api/v1/games/"+id+"/team", body, session...); rec.Code != 200 {
+					t.Errorf("join team %s: %d %s", id, rec.Code, rec.Body)
+					return
+				}
+				// Only some turns are our team's to end, so keep trying
+				// until the game has had enough.
+				for ended.Load() < turnsPerGame {
+					switch rec := do(s.mux, "POST", "/api/v1/games/"+id+"/end-turn", "", session...); rec.Code {
+					case 200:
+						ended.Add(1)
+					case 403:
+						runtime.Gosched()
+					default:
+						t.Errorf("end turn %s: %d %s", id, rec.Code, rec.Body)
+						return
+					}
+				}
+			}()
+		}
+	}
+
+	// Meanwhile, churn a separate set of games and the server-wide paths.
+	for i := 0; i < games; i++ {
+		id := fmt.Sprintf("churn%d", i)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// Only the creator, as host, may start the next game.
+			rec := do(s.mux, "POST", "/api/v1/games", fmt.Sprintf(`{"id": %q}`, id))
+			if rec.Code != 201 {
+				t.Errorf("create %s: %d %s", id, rec.Code, rec.Body)
+				return
+			}
+			host := rec.Result().Cookies()
+			for n := 0; n < turnsPerClient; n++ {
+				if rec := do(s.mux, "POST", "/api/v1/games/"+id+"/next-game", "", host...); rec.Code != 200 {
+					t.Errorf("next game %s: %d %s", id, rec.Code, rec.Body)
+				}
+				// The old route still works, but only for the host.
+				body := fmt.Sprintf(`{"game_id": %q}`, id)
+				if rec := do(s.mux, "POST", "/next-game", body); rec.Code != 401 {
+					t.Errorf("next game %s without a session: %d, want 401", id, rec.Code)
+				}
+				do(s.mux, "GET", "/api/v1/stats", "")
+				s.cleanupOldGames()
+				if err := s.flushGames(); err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	for i := 0; i < games; i++ {
+		e, ok := s.games.get(fmt.Sprintf("game%d", i))
+		if !ok {
+			t.Fatalf("game%d is missing", i)
+		}
+		want := int(ended[i].Load() % roundsPerGame)
+		if e.game.Round != want {
+			t.Errorf("game%d: round = %d, want %d", i, e.game.Round, want)
+		}
+	}
+	if n := s.games.len(); n != 2*games {
+		t.Errorf("registry has %d games, want %d", n, 2*games)
+	}
+}
+
+func TestIdleGamesExpire(t *testing.T) {
+	s := newTestServer()
+	clock := s.Clock.(*fakeClock)
+
+	do(s.mux, "POST", "/api/v1/games", `{"id": "old"}`)
+	clock.Advance(s.Config.GameTTL.Duration / 2)
+	do(s.mux, "POST", "/api/v1/games", `{"id": "new"}`)
+	clock.Advance(s.Config.GameTTL.Duration/2 + time.Second)
+
+	if removed := s.cleanupOldGames(); removed != 1 {
+		t.Errorf("removed %d games, want 1", removed)
+	}
+	if _, ok := s.games.get("old"); ok {
+		t.Error("old game wasn't removed")
+	}
+	if _, ok := s.games.get("new"); !ok {
+		t.Error("new game was removed")
+	}
+}
+
+func TestHostTimesOut(t *testing.T) {
+	s := newTestServer()
+	clock := s.Clock.(*fakeClock)
+
+	do(s.mux, "POST", "/api/v1/games", `{"id": "g"}`)
+	clock.Advance(time.Second)
+	guest := do(s.mux, "POST", "/api/v1/games/g/join", "").Result().Cookies()
+	clock.Advance(playerTimeout + time.Second)
+
+	var g GameResponse
+	rec := do(s.mux, "GET", "/api/v1/games/g", "", guest...)
+	if err := json.Unmarshal(rec.Body.Bytes(), &g); err != nil {
+		t.Fatal(err)
+	}
+	if g.HostID != g.PlayerID {
+		t.Errorf("host is %q, want the remaining player %q", g.HostID, g.PlayerID)
+	}
+}
+
+func TestAdminExport(t *testing.T) {
+	s := newTestServer()
+	clock := s.Clock.(*fakeClock)
+	start := clock.Now()
+	admin := http.HandlerFunc(s.handleAdmin)
+
+	for _, id := range []string{"first", "second", "third"} {
+		do(s.mux, "POST", "/api/v1/games", `{"id": "`+id+`"}`)
+		clock.Advance(time.Hour)
+		if rec := do(admin, "POST", "/admin/games/"+id+"/end", `{"winning_team": "red"}`); rec.Code != 200 {
+			t.Fatalf("ending %s: %d %s", id, rec.Code, rec.Body)
+		}
+	}
+
+	from := start.Add(90 * time.Minute).Format(time.RFC3339)
+	to := start.Add(3 * time.Hour).Format(time.RFC3339)
+	var export struct{ Games []GameRecord }
+	rec := do(admin, "GET", "/admin/export?from="+from+"&to="+to, "")
+	if err := json.Unmarshal(rec.Body.Bytes(), &export); err != nil {
+		t.Fatal(err)
+	}
+	if len(export.Games) != 1 || export.Games[0].ID != "second" {
+		t.Fatalf("exported %+v, want just the second game", export.Games)
+	}
+	if r := export.Games[0]; r.WinningTeam != Red || r.Duration != time.Hour.Seconds() {
+		t.Errorf("record has winner %s and duration %gs, want red and an hour", r.WinningTeam, r.Duration)
+	}
+
+	// One row per event, after the header.
+	rec = do(admin, "GET", "/admin/export?format=csv", "")
+	rows := strings.Split(strings.TrimSpace(rec.Body.String()), "\n")
+	if len(rows) != 1+3*2 {
+		t.Errorf("CSV export has %d rows, want a header and two events for each of three games:\n%s", len(rows), rec.Body)
+	}
+
+	if rec := do(admin, "GET", "/admin/export?from=yesterday", ""); rec.Code != http.StatusBadRequest {
+		t.Errorf("export with a bad time responded %d, want 400", rec.Code)
+	}
+}
+
+func TestFileStoreRecords(t *testing.T) {
+	store, err := newStore(StorageConfig{Backend: "file", Path: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := NewGame("g", []string{"a", "b", "c"}, GameState{Seed: 1}, &fakeClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)})
+	g.End(Blue)
+	// The same ID is used again by the next game.
+	next := NewGame("g", []string{"a", "b", "c"}, GameState{Seed: 2}, &fakeClock{now: time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC)})
+	next.End(Red)
+	for _, g := range []*Game{g, next} {
+		if err := store.SaveRecord(newGameRecord(g)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	records, err := store.LoadRecords()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 {
+		t.Fatalf("loaded %d records, want 2", len(records))
+	}
+	if r := records[0]; r.Seed != 1 || r.WinningTeam != Blue || len(r.Events) != 2 {
+		t.Errorf("loaded %+v, want the first game won by blue", r)
+	}
+}
+
+func TestProfileStats(t *testing.T) {
+	s := newTestServer()
+	clock := s.Clock.(*fakeClock)
+
+	// cookies holds each player's profile and session cookies.
+	cookies := make(map[string][]*http.Cookie)
+	play := func(who, method, path, body string) *httptest.ResponseRecorder {
+		clock.Advance(time.Second)
+		rec := do(s.mux, method, path, body, cookies[who]...)
+		cookies[who] = append(cookies[who], rec.Result().Cookies()...)
+		if rec.Code >= 400 {
+			t.Fatalf("%s %s %s as %s: %d %s", method, path, body, who, rec.Code, rec.Body)
+		}
+		return rec
+	}
+	profileIDs := make(map[string]string)
+	for who, body := range map[string]string{
+		"host":  `{"name": "Host", "league": "office"}`,
+		"other": `{"name": "Other", "league": "Office"}`,
+		"guest": `{"name": "Guest"}`,
+	} {
+		var prof CreateProfileResponse
+		json.Unmarshal(play(who, "POST", "/api/v1/profiles", body).Body.Bytes(), &prof)
+		profileIDs[who] = prof.ID
+	}
+
+	play("host", "POST", "/api/v1/games", `{"id": "g"}`)
+	play("guest", "POST", "/api/v1/games/g/join", `{}`)
+	play("other", "POST", "/api/v1/games/g/join", `{}`)
+	play("host", "POST", "/api/v1/games/g/team", `{"team": "red"}`)
+	play("guest", "POST", "/api/v1/games/g/team", `{"team": "blue"}`)
+	play("other", "POST", "/api/v1/games/g/team", `{"team": "blue"}`)
+	play("host", "POST", "/api/v1/games/g/end-turn", `{}`)
+	// The guest gives the clues, so the other blue player guesses: one
+	// of their cells, then the black one, losing the game.
+	play("guest", "POST", "/api/v1/games/g/end-turn", `{}`)
+	e, _ := s.games.get("g")
+	e.mu.Lock()
+	blue, black := -1, -1
+	for i, team := range e.game.Layout {
+		switch {
+		case team == Blue && blue < 0:
+			blue = i
+		case team == Black:
+			black = i
+		}
+	}
+	e.mu.Unlock()
+	play("other", "POST", "/api/v1/games/g/guess", fmt.Sprintf(`{"index": %d}`, blue))
+	play("other", "POST", "/api/v1/games/g/guess", fmt.Sprintf(`{"index": %d}`, black))
+
+	want := map[string]ProfileStats{
+		"host":  {Games: 1, Wins: 1},
+		"guest": {Games: 1},
+		"other": {Games: 1, WordsGuessed: 1, TimesTrapped: 1},
+	}
+	for who, stats := range want {
+		var prof Profile
+		json.Unmarshal(play(who, "GET", "/api/v1/profiles/me", "").Body.Bytes(), &prof)
+		if prof.Stats != stats {
+			t.Errorf("%s has stats %+v, want %+v", who, prof.Stats, stats)
+		}
+		if len(prof.Games) != 1 || prof.Games[0].GameID != "g" || prof.Games[0].Won != (who == "host") {
+			t.Errorf("%s has games %+v, want just g", who, prof.Games)
+		}
+	}
+
+	// Leagues are case insensitive, and the guest isn't in one.
+	var board LeaderboardResponse
+	json.Unmarshal(play("", "GET", "/api/v1/leagues/Office/leaderboard", "").Body.Bytes(), &board)
+	var ranked []string
+	for _, entry := range board.Entries {
+		ranked = append(ranked, entry.ProfileID)
+	}
+	if want := []string{profileIDs["host"], profileIDs["other"]}; fmt.Sprint(ranked) != fmt.Sprint(want) {
+		t.Errorf("office leaderboard is %v, want host then other %v", ranked, want)
+	}
+	json.Unmarshal(play("", "GET", "/api/v1/leaderboard?sort=words_guessed&limit=1", "").Body.Bytes(), &board)
+	if len(board.Entries) != 1 || board.Entries[0].ProfileID != profileIDs["other"] {
+		t.Errorf("top word guesser is %+v, want other", board.Entries)
+	}
+}
+
+func TestFileStoreProfiles(t *testing.T) {
+	store, err := newStore(StorageConfig{Backend: "file", Path: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	prof := &Profile{ID: "p", Name: "Player", TokenHash: hashToken("token"), Stats: ProfileStats{Games: 2, Wins: 1}}
+	if err := store.SaveProfile(prof); err != nil {
+		t.Fatal(err)
+	}
+	profiles, err := store.LoadProfiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The token still works after a restart.
+	r := newProfileRegistry()
+	for _, p := range profiles {
+		r.add(p)
+	}
+	if got, ok := r.forToken("token"); !ok || got.Name != "Player" || got.Stats != prof.Stats {
+		t.Errorf("after loading, the token finds %+v, want %+v", got, prof)
+	}
+}
+
+func TestMatch(t *testing.T) {
+	s := newTestServer()
+	admin := http.HandlerFunc(s.handleAdmin)
+	host := do(s.mux, "POST", "/api/v1/games", `{"id": "g", "match_length": 3}`).Result().Cookies()
+	play := func(winner string) *Match {
+		t.Helper()
+		if rec := do(admin, "POST", "/admin/games/g/end", `{"winning_team": "`+winner+`"}`); rec.Code != 200 {
+			t.Fatalf("ending the game: %d %s", rec.Code, rec.Body)
+		}
+		var g GameResponse
+		json.Unmarshal(do(s.mux, "GET", "/api/v1/games/g", "", host...).Body.Bytes(), &g)
+		return g.Match
+	}
+	nextGame := func() *Match {
+		t.Helper()
+		var g GameResponse
+		json.Unmarshal(do(s.mux, "POST", "/api/v1/games/g/next-game", `{}`, host...).Body.Bytes(), &g)
+		return g.Match
+	}
+
+	m := play("red")
+	id := m.ID
+	if m.Wins != (Scores{Red: 1}) || m.over() {
+		t.Fatalf("after red's win the match is %+v", m)
+	}
+	if m = nextGame(); m.ID != id || len(m.Games) != 1 {
+		t.Fatalf("the next game's match is %+v, want the same match", m)
+	}
+	// A draw counts as played but won by no one.
+	play("neutral")
+	nextGame()
+	m = play("blue")
+	if m.Wins != (Scores{Red: 1, Blue: 1}) || len(m.Games) != 3 || m.WinningTeam == nil || *m.WinningTeam != Neutral {
+		t.Fatalf("after three games the match is %+v, want a draw", m)
+	}
+
+	// Once it's over, the next game starts a rematch.
+	if m = nextGame(); m.ID == id || len(m.Games) != 0 || m.Length != 3 {
+		t.Fatalf("the next game's match is %+v, want a new match of 3", m)
+	}
+	play("blue")
+	nextGame()
+	if m = play("blue"); m.WinningTeam == nil || *m.WinningTeam != Blue || len(m.Games) != 2 {
+		t.Fatalf("after two blue wins the match is %+v, want blue to have won", m)
+	}
+
+	// Matches can't be shortened below the games played or changed
+	// once they're over.
+	rec := do(s.mux, "POST", "/api/v1/games/g/settings", `{"match_length": 5}`, host...)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("changing a finished match's length responded %d, want 400", rec.Code)
+	}
+	nextGame()
+	play("red")
+	rec = do(s.mux, "POST", "/api/v1/games/g/settings", `{"match_length": 1}`, host...)
+	var g GameResponse
+	json.Unmarshal(rec.Body.Bytes(), &g)
+	if g.Match == nil || g.Match.WinningTeam == nil || *g.Match.WinningTeam != Red {
+		t.Errorf("shortening the match to one game gave %+v, want red to have won", g.Match)
+	}
+}
+
+func TestNextGameKeepsRoom(t *testing.T) {
+	s := newTestServer()
+	host := do(s.mux, "POST", "/api/v1/games", `{"id": "g", "match_length": 3}`).Result().Cookies()
+	s.Clock.(*fakeClock).Advance(time.Second)
+	guest := do(s.mux, "POST", "/api/v1/games/g/join", "").Result().Cookies()
+	do(s.mux, "POST", "/api/v1/games/g/team", `{"team": "red"}`, host...)
+	do(s.mux, "POST", "/api/v1/games/g/team", `{"team": "blue"}`, guest...)
+	if rec := do(http.HandlerFunc(s.handleAdmin), "POST", "/admin/games/g/end", `{"winning_team": "red"}`); rec.Code != 200 {
+		t.Fatalf("ending the game: %d %s", rec.Code, rec.Body)
+	}
+
+	nextGame := func(body string) GameResponse {
+		t.Helper()
+		var g GameResponse
+		rec := do(s.mux, "POST", "/api/v1/games/g/next-game", body, host...)
+		if err := json.Unmarshal(rec.Body.Bytes(), &g); err != nil {
+			t.Fatalf("next game: %d %s", rec.Code, rec.Body)
+		}
+		return g
+	}
+
+	g := nextGame(`{}`)
+	if g.Team != Red || len(g.Players) != 2 || g.Players[1].Team != Blue {
+		t.Fatalf("after the next game the players are %+v, want them on the same teams", g.Players)
+	}
+	g = nextGame(`{"swap_teams": true}`)
+	if g.Team != Blue || g.Players[1].Team != Red {
+		t.Errorf("after swapping the players are %+v, want them on the other teams", g.Players)
+	}
+	if g.Match.Wins != (Scores{Blue: 1}) {
+		t.Errorf("after swapping the match is %+v, want the host's win to count for blue", g.Match)
+	}
+	// The history swaps too, so it agrees with the tally.
+	var wins Scores
+	for _, game := range g.Match.Games {
+		switch game.WinningTeam {
+		case Red:
+			wins.Red++
+		case Blue:
+			wins.Blue++
+		}
+		for _, p := range game.Players {
+			if p.ID == g.PlayerID && p.Team != game.WinningTeam {
+				t.Errorf("after swapping the host is on %s in game %d, which %s won", p.Team, game.Number, game.WinningTeam)
+			}
+		}
+	}
+	if wins != g.Match.Wins {
+		t.Errorf("after swapping the match's games add up to %+v wins, but its tally is %+v", wins, g.Match.Wins)
+	}
+	if e, _ := s.games.get("g"); e.game.Words == nil || e.game.HostID != g.PlayerID {
+		t.Errorf("the next game lost its room: %+v", e.game.Room)
+	}
+}
+
+func TestFileStoreLoadsGamesWithoutRooms(t *testing.T) {
+	store, err := newStore(StorageConfig{Backend: "file", Path: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// How games were saved before rooms, with the room's fields on the
+	// game itself.
+	type game struct {
+		GameState
+		ID         string
+		Revision   int64
+		Words      []string
+		WordSource string
+		HostID     string
+		Players    map[string]*Player
+		Layout     []Team
+	}
+	old := game{
+		GameState: GameState{Seed: 1},
+		ID:        "g",
+		Revision:  3,
+		Words:     []string{"a", "b"},
+		HostID:    "p",
+		Players:   map[string]*Player{"p": {ID: "p", Team: Red}},
+		Layout:    []Team{Red, Blue},
+	}
+	err = writeAtomically(store.(fileStore).path("g"), func(w io.Writer) error {
+		return gob.NewEncoder(w).Encode(old)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	games, err := store.LoadGames()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(games) != 1 {
+		t.Fatalf("loaded %d games, want 1", len(games))
+	}
+	g := games[0]
+	if g.Room == nil || g.ID != "g" || g.Revision != 3 || g.HostID != "p" || g.Players["p"].Team != Red || len(g.Words) != 2 || len(g.Layout) != 2 {
+		t.Errorf("loaded %+v with room %+v, want the old game", g, g.Room)
+	}
+}
+
+func TestSpectators(t *testing.T) {
+	g := NewGame("g", []string{"a", "b", "c", "d"}, GameState{Seed: 1}, &fakeClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)})
+	now := g.now()
+	g.touch("host", now)
+	g.touch("fan", now.Add(time.Second))
+	g.spectate("host", true, now)
+	if g.HostID != "fan" || g.Players["host"].Team != Neutral {
+		t.Errorf("after the host started spectating, the host is %q, want the other player", g.HostID)
+	}
+	if n := g.spectators(now); n != 1 || len(g.playerList(now)) != 1 {
+		t.Errorf("counted %d spectators and %d players, want one of each", n, len(g.playerList(now)))
+	}
+
+	// Red guesses the first word and blue the second; each is hidden
+	// until that turn is over.
+	for _, tt := range []struct {
+		round int
+		shown []bool
+	}{
+		{0, []bool{false, false}},
+		{2, []bool{false, false}},
+		{3, []bool{false, true}},
+		{4, []bool{false, true}},
+		{5, []bool{false, false}},
+		{8, []bool{true, false}},
+	} {
+		g.SetRound(tt.round)
+		for i, w := range g.spectatorWords() {
+			if shown := w != ""; shown != tt.shown[i] || shown && w != g.RoundWords[i] {
+				t.Errorf("in round %d spectators see word %d as %q, want it shown: %v", tt.round, i, w, tt.shown[i])
+			}
+		}
+	}
+	g.End(Red)
+	if words := g.spectatorWords(); words[0] == "" || words[1] == "" {
+		t.Errorf("after the game spectators see %q, want every word", words)
+	}
+
+	g.spectate("host", false, now)
+	if g.Players["host"].Spectator || len(g.playerList(now)) != 2 {
+		t.Errorf("after joining to play, %+v is still a spectator", g.Players["host"])
+	}
+}
+
+func TestFileStoreGames(t *testing.T) {
+	store, err := newStore(StorageConfig{Backend: "file", Path: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newTestServer()
+	s.store = store
+	do(s.mux, "POST", "/api/v1/games", `{"id": "default"}`)
+	do(s.mux, "POST", "/api/v1/games", `{"id": "custom"}`)
+	custom, _ := s.games.get("custom")
+	custom.game.WordSource = "https://example.com/words.txt"
+	custom.game.Words = []string{"a", "b", "c"}
+	s.gameChanged(custom)
+
+	games, err := store.LoadGames()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, g := range games {
+		switch g.ID {
+		case "default":
+			if g.Words != nil {
+				t.Errorf("saved the default word list with game %q", g.ID)
+			}
+		case "custom":
+			if len(g.Words) != 3 {
+				t.Errorf("game %q was saved with words %q, want its own list", g.ID, g.Words)
+			}
+		}
+	}
+
+	// A request that was waiting on a game when it was deleted mustn't
+	// save it again.
+	e, _ := s.games.get("default")
+	s.deleteGame("default", e)
+	e.mu.Lock()
+	s.gameChanged(e)
+	e.mu.Unlock()
+	if games, _ := store.LoadGames(); len(games) != 1 {
+		t.Errorf("after deleting a game the store has %d games, want 1", len(games))
+	}
+}
+
+func TestRateLimitGameCreation(t *testing.T) {
+	s := newTestServer()
+	s.limits = newRateLimiters(RateLimitConfig{GameCreation: Limit{1, time.Hour}}, s.clock())
+	h := s.rateLimit(s.mux)
+	if rec := do(h, "POST", "/api/v1/games", `{"id": "first"}`); rec.Code != http.StatusCreated {
+		t.Fatalf("creating a game: %d %s", rec.Code, rec.Body)
+	}
+
+	// Recreating a game the server doesn't know from its state ID
+	// creates it as surely as asking to.
+	stateID := GameState{Seed: 1}.ID()
+	if rec := do(h, "GET", "/api/v1/games/second?state_id="+stateID, ""); rec.Code != http.StatusTooManyRequests {
+		t.Errorf("recreating a game over the limit got %d, want 429", rec.Code)
+	}
+	if rec := do(h, "POST", "/api/v1/games/third/end-turn", `{"state_id": "`+stateID+`"}`); rec.Code != http.StatusTooManyRequests {
+		t.Errorf("ending a turn in an unknown game over the limit got %d, want 429", rec.Code)
+	}
+	if rec := do(h, "GET", "/api/v1/games/first?state_id="+stateID, ""); rec.Code != http.StatusOK {
+		t.Errorf("fetching an existing game got %d, want 200", rec.Code)
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	s := newTestServer()
+	if err := s.Config.TrustedProxies.Set("10.0.0.0/8, 192.168.1.1"); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		remote, forwarded, want string
+	}{
+		{"203.0.113.9:1234", "198.51.100.1", "203.0.113.9"},
+		{"10.1.2.3:1234", "", "10.1.2.3"},
+		{"10.1.2.3:1234", "198.51.100.1", "198.51.100.1"},
+		{"192.168.1.1:1234", "198.51.100.7, 198.51.100.1, 10.0.0.5", "198.51.100.1"},
+		{"10.1.2.3:1234", "198.51.100.1, nonsense", "10.1.2.3"},
+	} {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = tt.remote
+		if tt.forwarded != "" {
+			req.Header.Set("X-Forwarded-For", tt.forwarded)
+		}
+		if got := s.clientIP(req); got != tt.want {
+			t.Errorf("request from %s forwarded for %q came from %s, want %s", tt.remote, tt.forwarded, got, tt.want)
+		}
+	}
+}
+
+func TestDeals(t *testing.T) {
+	words := make([]string, 50)
+	for i := range words {
+		words[i] = fmt.Sprintf("WORD%d", i)
+	}
+	// Dealing used to depend on the wall clock, and divided by zero at
+	// the epoch.
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	g := NewGame("g", words, GameState{Seed: 7}, clock)
+	first := append([]string(nil), g.RoundWords...)
+	g.SetRound(4)
+	host := &Player{ID: "host", Team: Red}
+	g.nextRound(host)
+	if reflect.DeepEqual(g.RoundWords, first) {
+		t.Errorf("the second deal was %q again", first)
+	}
+	if again := NewGame("g", words, GameState{Seed: 7}, &fakeClock{now: time.Unix(1e9, 0)}); !reflect.DeepEqual(again.RoundWords, first) {
+		t.Errorf("the same seed dealt %q, then %q", first, again.RoundWords)
+	}
+}
+
+func TestExportRemovedGame(t *testing.T) {
+	s := newTestServer()
+	host := do(s.mux, "POST", "/api/v1/games", `{"id": "g"}`).Result().Cookies()
+	e, _ := s.games.get("g")
+	e.mu.Lock()
+	e.game.End(Red)
+	s.gameChanged(e)
+	e.mu.Unlock()
+
+	// Downloading a game doesn't make the downloader one of its players.
+	rec := do(s.mux, "GET", "/api/v1/games/g/export", "")
+	if rec.Code != http.StatusOK || len(rec.Result().Cookies()) != 0 {
+		t.Errorf("exporting the game got %d with cookies %v, want 200 and none", rec.Code, rec.Result().Cookies())
+	}
+	if n := len(e.game.Players); n != 1 {
+		t.Errorf("after an export the game has %d players, want just the host", n)
+	}
+
+	s.deleteGame("g", e)
+	if rec := do(s.mux, "GET", "/api/v1/games/g/export", "", host...); rec.Code != http.StatusOK {
+		t.Errorf("exporting the game once it was removed got %d %s, want the archived record", rec.Code, rec.Body)
+	}
+}
+
+func TestGameIDs(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	taken := false
+	ids := newGameIDGenerator([]string{"lemon"}, clock, rand.New(rand.NewSource(1)), func(string) bool { return taken })
+	if id := ids.Suggest(); id != "lemon-lemon-lemon" {
+		t.Fatalf("first suggestion was %q", id)
+	}
+	// The only combination is reserved, so a number is added.
+	if id := ids.Suggest(); !strings.HasPrefix(id, "lemon-lemon-lemon-") {
+		t.Errorf("with every combination reserved the suggestion was %q, want a number added", id)
+	}
+	// With everything taken, the time is added instead.
+	taken = true
+	want := "lemon-lemon-lemon-" + strconv.FormatInt(clock.Now().UnixNano(), 36)
+	if id := ids.Suggest(); id != want {
+		t.Errorf("with every ID taken the suggestion was %q, want %q", id, want)
+	}
+
+	// Reservations run out.
+	taken = false
+	clock.Advance(gameIDReservation + time.Second)
+	if id := ids.Suggest(); id != "lemon-lemon-lemon" {
+		t.Errorf("after the reservations expired the suggestion was %q, want the plain combination again", id)
+	}
+
+	// Creating a game releases its ID's reservation.
+	s := newTestServer()
+	id := s.gameIDs.Suggest()
+	do(s.mux, "POST", "/api/v1/games", fmt.Sprintf(`{"id": %q}`, id))
+	s.gameIDs.mu.Lock()
+	_, reserved := s.gameIDs.reserved[id]
+	s.gameIDs.mu.Unlock()
+	if reserved {
+		t.Errorf("%q is still reserved after a game was created with it", id)
+	}
+}
+
+func TestPollers(t *testing.T) {
+	s := newTestServer()
+	clock := s.Clock.(*fakeClock)
+	do(s.mux, "GET", "/api/v1/games/missing", "")
+	if n := s.metrics.pollers.count(); n != 0 {
+		t.Errorf("polling a game that doesn't exist counted %d clients, want 0", n)
+	}
+	do(s.mux, "POST", "/api/v1/games", `{"id": "a"}`)
+	do(s.mux, "POST", "/api/v1/games", `{"id": "b"}`)
+	do(s.mux, "GET", "/api/v1/games/a", "")
+	clock.Advance(time.Minute)
+	do(s.mux, "GET", "/api/v1/games/b", "")
+	s.metrics.pollers.mu.Lock()
+	_, stale := s.metrics.pollers.lastSeen["a"]
+	s.metrics.pollers.mu.Unlock()
+	if stale {
+		t.Error("a game nobody has polled for a minute is still tracked")
+	}
+}
+
+// TestKick checks what kicking someone keeps them from. Their session
+// stops working, but with a new one they're a newcomer, so only a
+// password keeps them out.
+func TestKick(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		create   string
+		rejoined int
+	}{
+		{"public", `{"id": "g"}`, http.StatusOK},
+		{"private", `{"id": "g", "password": "secret"}`, http.StatusForbidden},
+	} {
+		s := newTestServer()
+		host := do(s.mux, "POST", "/api/v1/games", tt.create).Result().Cookies()
+		joined := do(s.mux, "POST", "/api/v1/games/g/join", `{"password": "secret"}`)
+		var g GameResponse
+		json.Unmarshal(joined.Body.Bytes(), &g)
+		kicked := joined.Result().Cookies()
+		if rec := do(s.mux, "POST", "/api/v1/games/g/kick", fmt.Sprintf(`{"player_id": %q}`, g.PlayerID), host...); rec.Code != http.StatusOK {
+			t.Fatalf("%s: kicking got %d %s", tt.name, rec.Code, rec.Body)
+		}
+
+		if rec := do(s.mux, "POST", "/api/v1/games/g/join", `{"password": "secret"}`, kicked...); rec.Code != http.StatusForbidden {
+			t.Errorf("%s: rejoining with the kicked session got %d, want 403", tt.name, rec.Code)
+		}
+		rec := do(s.mux, "POST", "/api/v1/games/g/join", `{}`)
+		if rec.Code != tt.rejoined {
+			t.Errorf("%s: joining again without the session or password got %d, want %d", tt.name, rec.Code, tt.rejoined)
+		}
+	}
+}
+
+// profileSaves is a store that keeps the last copy of each profile
+// saved.
+type profileSaves struct {
+	memoryStore
+	mu    sync.Mutex
+	saved map[string]*Profile
+}
+
+func (ps *profileSaves) SaveProfile(p *Profile) error {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	ps.saved[p.ID] = p
+	return nil
+}
+
+func TestProfileSavesInOrder(t *testing.T) {
+	s := newTestServer()
+	store := &profileSaves{saved: make(map[string]*Profile)}
+	s.store = store
+	s.profiles.add(&Profile{ID: "p", TokenHash: hashToken("token")})
+
+	// Each game is recorded concurrently, so the copies of the profile
+	// are saved concurrently too; the last one saved must be the newest.
+	const games = 50
+	var wg sync.WaitGroup
+	for i := 0; i < games; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			s.recordProfileGames(&GameRecord{
+				ID:          fmt.Sprintf("g%d", i),
+				WinningTeam: Red,
+				Players:     []PlayerInfo{{ID: "a", Team: Red, ProfileID: "p"}},
+			})
+		}(i)
+	}
+	wg.Wait()
+	if n := store.saved["p"].Stats.Games; n != games {
+		t.Errorf("the last copy of the profile saved has %d games, want %d", n, games)
+	}
+}
+
+// TestSpectatorsCantDeal checks that nothing spectators or anonymous
+// readers are sent lets them work out the words.
+func TestSpectatorsCantDeal(t *testing.T) {
+	s := newTestServer()
+	host := do(s.mux, "POST", "/api/v1/games", `{"id": "g"}`).Result().Cookies()
+	watcher := do(s.mux, "POST", "/api/v1/games/g/join", `{"spectator": true}`)
+	e, _ := s.games.get("g")
+	e.mu.Lock()
+	seed, stateID := strconv.FormatInt(e.game.Seed, 10), e.game.GameState.ID()
+	e.mu.Unlock()
+
+	for name, rec := range map[string]*httptest.ResponseRecorder{
+		"spectator joining": watcher,
+		"spectator polling": do(s.mux, "GET", "/api/v1/games/g", "", watcher.Result().Cookies()...),
+		"anonymous reader":  do(s.mux, "GET", "/api/v1/games/g", ""),
+	} {
+		body := rec.Body.String()
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: %d %s", name, rec.Code, body)
+		}
+		if strings.Contains(body, seed) || strings.Contains(body, stateID) || strings.Contains(body, "state_id") {
+			t.Errorf("%s: the response gives away the seed or state ID: %s", name, body)
+		}
+	}
+	rec := do(s.mux, "GET", "/api/v1/games/g", "", host...)
+	if body := rec.Body.String(); !strings.Contains(body, seed) || !strings.Contains(body, stateID) {
+		t.Errorf("the host doesn't get the seed and state ID: %s", body)
+	}
+}
@@ -0,0 +1,243 @@
+package trapwords
+
+import (
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// sessionLifetime is how long a session cookie stays valid.
+	sessionLifetime = 7 * 24 * time.Hour
+
+	passwordIterations = 100000
+	passwordKeyLength  = 32
+)
+
+// gamePassword is a salted hash of a private game's password.
+type gamePassword struct {
+	Salt []byte
+	Hash []byte
+}
+
+func hashPassword(password string) (*gamePassword, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	hash, err := pbkdf2.Key(sha256.New, password, salt, passwordIterations, passwordKeyLength)
+	if err != nil {
+		return nil, err
+	}
+	return &gamePassword{Salt: salt, Hash: hash}, nil
+}
+
+func (p *gamePassword) matches(password string) bool {
+	hash, err := pbkdf2.Key(sha256.New, password, p.Salt, passwordIterations, passwordKeyLength)
+	return err == nil && subtle.ConstantTimeCompare(hash, p.Hash) == 1
+}
+
+// sessionKey returns the key that session cookies are signed with:
+// derived from SessionSecret if there is one, otherwise random.
+func (c Config) sessionKey() ([]byte, error) {
+	if c.SessionSecret != "" {
+		sum := sha256.Sum256([]byte(c.SessionSecret))
+		return sum[:], nil
+	}
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// session identifies a player who has joined a particular game. Room
+// is the room's nonce, which tells apart rooms that reuse an ID.
+type session struct {
+	GameID   string `json:"g"`
+	Room     int64  `json:"r,omitempty"`
+	PlayerID string `json:"p"`
+	Expires  int64  `json:"e"`
+}
+
+// sessionCookieName returns the name of the cookie holding the session
+// for gameID. Game IDs can contain anything, so they're hashed.
+func sessionCookieName(gameID string) string {
+	sum := sha256.Sum256([]byte(gameID))
+	return "trapwords_" + hex.EncodeToString(sum[:8])
+}
+
+func newPlayerID() string {
+	b := make([]byte, 12)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// sign encodes sess as "<payload>.<mac>", both base64.
+func (s *Server) sign(sess session) string {
+	payload, _ := json.Marshal(sess)
+	mac := hmac.New(sha256.New, s.sessionKey)
+	mac.Write(payload)
+	return base64.RawURLEncoding.EncodeToString(payload) + "." +
+		base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (s *Server) verify(value string) (session, error) {
+	var sess session
+	encodedPayload, encodedMAC, ok := strings.Cut(value, ".")
+	if !ok {
+		return sess, errors.New("malformed session")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encodedPayload)
+	if err != nil {
+		return sess, err
+	}
+	got, err := base64.RawURLEncoding.DecodeString(encodedMAC)
+	if err != nil {
+		return sess, err
+	}
+	mac := hmac.New(sha256.New, s.sessionKey)
+	mac.Write(payload)
+	if !hmac.Equal(got, mac.Sum(nil)) {
+		return sess, errors.New("bad session signature")
+	}
+	if err := json.Unmarshal(payload, &sess); err != nil {
+		return sess, err
+	}
+	if s.now().Unix() > sess.Expires {
+		return sess, errors.New("session expired")
+	}
+	return sess, nil
+}
+
+// startSession gives the client a new session for g's room.
+func (s *Server) startSession(rw http.ResponseWriter, req *http.Request, g *Game) session {
+	sess := session{
+		GameID:   g.ID,
+		Room:     g.RoomNonce,
+		PlayerID: newPlayerID(),
+		Expires:  s.now().Add(sessionLifetime).Unix(),
+	}
+	http.SetCookie(rw, &http.Cookie{
+		Name:     sessionCookieName(g.ID),
+		Value:    s.sign(sess),
+		Path:     "/",
+		MaxAge:   int(sessionLifetime.Seconds()),
+		HttpOnly: true,
+		Secure:   req.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return sess
+}
+
+// sessionFor returns the client's session for the room with gameID
+// and nonce room, if it has a valid one.
+func (s *Server) sessionFor(req *http.Request, gameID string, room int64) (session, bool) {
+	c, err := req.Cookie(sessionCookieName(gameID))
+	if err != nil {
+		return session{}, false
+	}
+	sess, err := s.verify(c.Value)
+	if err != nil || sess.GameID != gameID || sess.Room != room {
+		return session{}, false
+	}
+	return sess, true
+}
+
+// player returns the session of the client making req and marks them
+// as present in e's game. Clients become players by creating or joining
+// the game. If the client hasn't, or may no longer play it, player
+// writes the error and returns false.
+func (s *Server) player(rw http.ResponseWriter, req *http.Request, e *gameEntry) (session, bool) {
+	g := e.game
+	sess, ok := s.sessionFor(req, g.ID, g.RoomNonce)
+	switch {
+	case !ok && g.Private:
+		writeError(rw, http.StatusUnauthorized, "private_game", "This game is private, join it with its password first")
+		return session{}, false
+	case !ok:
+		writeError(rw, http.StatusUnauthorized, "not_joined", "Join this game first")
+		return session{}, false
+	case g.Kicked[sess.PlayerID]:
+		writeError(rw, http.StatusForbidden, "kicked", "You were removed from this game")
+		return session{}, false
+	}
+	host := g.HostID
+	g.touch(sess.PlayerID, s.now())
+	s.hostMoved(e, host)
+	s.linkProfile(req, g, sess.PlayerID)
+	return sess, true
+}
+
+// reader is like player, but lets clients that haven't joined a public
+// game read it anonymously, with an empty session. They aren't added
+// to the game, so merely looking doesn't make anyone a player.
+func (s *Server) reader(rw http.ResponseWriter, req *http.Request, e *gameEntry) (session, bool) {
+	if _, ok := s.sessionFor(req, e.game.ID, e.game.RoomNonce); !ok && !e.game.Private {
+		return session{}, true
+	}
+	return s.player(rw, req, e)
+}
+
+// POST /api/v1/games/<id>/join
+//
+// Exchanges a private game's password for a session cookie. Joining a
+// public game needs no password. Players joining as spectators only
+// watch; joining again without asking to spectate makes them players.
+func (s *Server) handleJoin(rw http.ResponseWriter, req *http.Request) {
+	var request JoinRequest
+	if !decodeRequest(rw, req, &request) {
+		return
+	}
+
+	e := s.lockGame(rw, req, "")
+	if e == nil {
+		return
+	}
+	private, password := e.game.Private, e.game.Password
+	e.mu.Unlock()
+
+	// Checking the password is deliberately slow, so do it without
+	// holding up everyone else in the game.
+	if private && (password == nil || !password.matches(request.Password)) {
+		s.logFor(req).Info("wrong game password", "game_id", req.PathValue("id"))
+		writeError(rw, http.StatusForbidden, "wrong_password", "Wrong password")
+		return
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	g := e.game
+	if e.removed {
+		writeError(rw, http.StatusNotFound, "game_not_found", "No such game")
+		return
+	}
+	if g.Private && g.Password != password {
+		// The host changed the password while we were checking.
+		writeError(rw, http.StatusForbidden, "wrong_password", "Wrong password")
+		return
+	}
+	sess, ok := s.sessionFor(req, g.ID, g.RoomNonce)
+	if ok && g.Kicked[sess.PlayerID] {
+		writeError(rw, http.StatusForbidden, "kicked", "You were removed from this game")
+		return
+	}
+	if !ok {
+		sess = s.startSession(rw, req, g)
+	}
+	host := g.HostID
+	g.touch(sess.PlayerID, s.now())
+	g.spectate(sess.PlayerID, request.Spectator, s.now())
+	s.hostMoved(e, host)
+	s.linkProfile(req, g, sess.PlayerID)
+	writeGame(rw, g, sess)
+}
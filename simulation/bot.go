@@ -0,0 +1,101 @@
+package simulation
+
+import (
+	"math/rand"
+	"time"
+
+	"github.com/banool/trapwords"
+)
+
+// ActionKind is something a bot can do on its turn.
+type ActionKind int
+
+const (
+	// Wait does nothing.
+	Wait ActionKind = iota
+	EndTurn
+	Guess
+)
+
+func (k ActionKind) String() string {
+	switch k {
+	case EndTurn:
+		return "end turn"
+	case Guess:
+		return "guess"
+	default:
+		return "wait"
+	}
+}
+
+// Action is what a bot decided to do. Index is the cell to guess.
+type Action struct {
+	Kind  ActionKind
+	Index int
+}
+
+// A Bot plays one player. Act is called whenever the simulation picks
+// that player to act, with the game as it stands and the time.
+type Bot interface {
+	Act(g *trapwords.Game, p *trapwords.Player, now time.Time, rnd *rand.Rand) Action
+}
+
+// BotFunc lets an ordinary function be a Bot.
+type BotFunc func(g *trapwords.Game, p *trapwords.Player, now time.Time, rnd *rand.Rand) Action
+
+func (f BotFunc) Act(g *trapwords.Game, p *trapwords.Player, now time.Time, rnd *rand.Rand) Action {
+	return f(g, p, now, rnd)
+}
+
+// RandomBot plays sensibly, but with probability Mistakes does
+// something at random instead, which may well be refused.
+type RandomBot struct {
+	Mistakes float64
+}
+
+func (b RandomBot) Act(g *trapwords.Game, p *trapwords.Player, now time.Time, rnd *rand.Rand) Action {
+	if rnd.Float64() < b.Mistakes {
+		// Indexes one either side of the board are deliberately
+		// included.
+		return Action{Kind: ActionKind(rnd.Intn(3)), Index: rnd.Intn(len(g.Layout)+2) - 1}
+	}
+
+	phase := g.Phase()
+	if team := phase.Team(); team != trapwords.Neutral && team != p.Team {
+		return Action{Kind: Wait}
+	}
+	if phase != trapwords.PhaseBlueGuessing && phase != trapwords.PhaseRedGuessing {
+		return Action{Kind: EndTurn}
+	}
+	// The cluegiver ends the turn once time is up.
+	if p.ID == g.Cluegiver {
+		if now.Unix() >= g.GuessEnd {
+			return Action{Kind: EndTurn}
+		}
+		return Action{Kind: Wait}
+	}
+	var hidden []int
+	for i, revealed := range g.Revealed {
+		if !revealed {
+			hidden = append(hidden, i)
+		}
+	}
+	if len(hidden) == 0 {
+		return Action{Kind: EndTurn}
+	}
+	return Action{Kind: Guess, Index: hidden[rnd.Intn(len(hidden))]}
+}
+
+// ScriptedBot takes its actions in order, then waits.
+type ScriptedBot struct {
+	Actions []Action
+}
+
+func (b *ScriptedBot) Act(*trapwords.Game, *trapwords.Player, time.Time, *rand.Rand) Action {
+	if len(b.Actions) == 0 {
+		return Action{Kind: Wait}
+	}
+	a := b.Actions[0]
+	b.Actions = b.Actions[1:]
+	return a
+}
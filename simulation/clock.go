@@ -0,0 +1,22 @@
+package simulation
+
+import "time"
+
+// Clock is a fake clock that only moves when it's told to.
+type Clock struct {
+	now time.Time
+}
+
+// NewClock returns a clock stopped at start.
+func NewClock(start time.Time) *Clock {
+	return &Clock{now: start}
+}
+
+func (c *Clock) Now() time.Time {
+	return c.now
+}
+
+// Advance moves the clock on by d.
+func (c *Clock) Advance(d time.Duration) {
+	c.now = c.now.Add(d)
+}
@@ -0,0 +1,269 @@
+// Package simulation plays whole games of Trapwords with bots, without
+// a server, checking after every move that the game still makes sense.
+// Everything is driven by a seed and a fake clock, so a run that finds
+// a problem can be replayed exactly.
+package simulation
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/banool/trapwords"
+)
+
+// Config describes a simulation.
+type Config struct {
+	// Seed determines the game's layout and everything the bots and
+	// the clock do.
+	Seed int64
+	// Players is how many players there are, split between the red and
+	// blue teams. There must be at least two.
+	Players int
+	// Bot returns the bot playing player i. It defaults to a RandomBot
+	// that makes mistakes a tenth of the time.
+	Bot func(i int) Bot
+	// MaxSteps is how many moves the game may take before the
+	// simulation gives up on it.
+	MaxSteps int
+	// MaxPause is the most time that passes between moves.
+	MaxPause time.Duration
+	// Words are the words the game is played with.
+	Words []string
+	// Start is the time the simulated clock starts at.
+	Start time.Time
+}
+
+// DefaultConfig returns a config for a game of four random bots.
+func DefaultConfig(seed int64) Config {
+	words := make([]string, 50)
+	for i := range words {
+		words[i] = fmt.Sprintf("word%d", i)
+	}
+	return Config{
+		Seed:     seed,
+		Players:  4,
+		MaxSteps: 10000,
+		MaxPause: 10 * time.Second,
+		Words:    words,
+		Start:    time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+	}
+}
+
+// Result describes a finished simulation.
+type Result struct {
+	Game *trapwords.Game
+	// Steps is how many moves were made, and Refused how many of them
+	// the game refused.
+	Steps   int
+	Refused int
+	// Winner is the team that won, or nil if the game never finished.
+	Winner *trapwords.Team
+}
+
+// Violation is returned when a game breaks one of the invariants.
+type Violation struct {
+	Seed      int64
+	Step      int
+	Invariant string
+	Detail    string
+}
+
+func (v *Violation) Error() string {
+	return fmt.Sprintf("seed %d, step %d: %s: %s", v.Seed, v.Step, v.Invariant, v.Detail)
+}
+
+// Run plays a game according to cfg. It returns a *Violation if the
+// game breaks an invariant.
+func Run(cfg Config) (*Result, error) {
+	if cfg.Players < 2 {
+		return nil, fmt.Errorf("a game needs at least 2 players, one for each team, not %d", cfg.Players)
+	}
+	if cfg.Bot == nil {
+		cfg.Bot = func(int) Bot { return RandomBot{Mistakes: 0.1} }
+	}
+	rnd := rand.New(rand.NewSource(cfg.Seed))
+	clock := NewClock(cfg.Start)
+	g := trapwords.NewGame(fmt.Sprintf("sim-%d", cfg.Seed), cfg.Words, trapwords.GameState{Seed: cfg.Seed}, clock)
+
+	players := make([]*trapwords.Player, cfg.Players)
+	bots := make([]Bot, cfg.Players)
+	for i := range players {
+		team := trapwords.Red
+		if i%2 == 1 {
+			team = trapwords.Blue
+		}
+		players[i] = &trapwords.Player{ID: fmt.Sprintf("p%d", i), Team: team, Joined: clock.Now(), Seen: clock.Now()}
+		bots[i] = cfg.Bot(i)
+	}
+
+	res := &Result{Game: g}
+	check := newChecker(g)
+	if problem := check.after(Action{Kind: Wait}, nil, clock.Now()); problem != nil {
+		problem.Seed = cfg.Seed
+		return res, problem
+	}
+	for res.Steps < cfg.MaxSteps && g.WinningTeam == nil {
+		res.Steps++
+		i := rnd.Intn(len(players))
+		p := players[i]
+		action := bots[i].Act(g, p, clock.Now(), rnd)
+
+		var err error
+		switch action.Kind {
+		case EndTurn:
+			err = g.NextTurn(p)
+		case Guess:
+			err = g.Guess(p, action.Index)
+		}
+		if err != nil {
+			res.Refused++
+		}
+
+		if problem := check.after(action, err, clock.Now()); problem != nil {
+			problem.Seed = cfg.Seed
+			problem.Step = res.Steps
+			return res, problem
+		}
+		clock.Advance(time.Duration(rnd.Int63n(int64(cfg.MaxPause) + 1)))
+	}
+
+	// A finished game refuses everything.
+	if g.WinningTeam != nil {
+		for _, p := range players {
+			if g.NextTurn(p) == nil {
+				return res, &Violation{cfg.Seed, res.Steps, "winner decided once", p.ID + " ended a turn after the game was over"}
+			}
+			for i := range g.Layout {
+				if g.Guess(p, i) == nil {
+					return res, &Violation{cfg.Seed, res.Steps, "winner decided once", fmt.Sprintf("%s guessed cell %d after the game was over", p.ID, i)}
+				}
+			}
+		}
+	}
+	res.Winner = g.WinningTeam
+	return res, nil
+}
+
+// phaseOrder is the order of a game's phases, a round each, before it
+// starts over.
+var phaseOrder = []trapwords.Phase{
+	trapwords.PhaseTrapwords,
+	trapwords.PhaseBlueReady,
+	trapwords.PhaseBlueGuessing,
+	trapwords.PhaseRedReady,
+	trapwords.PhaseRedGuessing,
+	trapwords.PhaseTrapwords,
+	trapwords.PhaseRedReady,
+	trapwords.PhaseRedGuessing,
+	trapwords.PhaseBlueReady,
+}
+
+// snapshot is the part of a game the invariants are about.
+type snapshot struct {
+	round     int
+	guessEnd  int64
+	cluegiver string
+	revealed  []bool
+	winner    *trapwords.Team
+}
+
+func takeSnapshot(g *trapwords.Game) snapshot {
+	s := snapshot{
+		round:     g.Round,
+		guessEnd:  g.GuessEnd,
+		cluegiver: g.Cluegiver,
+		revealed:  append([]bool(nil), g.Revealed...),
+	}
+	if g.WinningTeam != nil {
+		w := *g.WinningTeam
+		s.winner = &w
+	}
+	return s
+}
+
+func (s snapshot) equal(o snapshot) bool {
+	if s.round != o.round || s.guessEnd != o.guessEnd || s.cluegiver != o.cluegiver ||
+		(s.winner == nil) != (o.winner == nil) || (s.winner != nil && *s.winner != *o.winner) ||
+		len(s.revealed) != len(o.revealed) {
+		return false
+	}
+	for i := range s.revealed {
+		if s.revealed[i] != o.revealed[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// checker checks the game's invariants after each move, comparing it
+// with how it was before.
+type checker struct {
+	g    *trapwords.Game
+	prev snapshot
+}
+
+func newChecker(g *trapwords.Game) *checker {
+	return &checker{g: g, prev: takeSnapshot(g)}
+}
+
+func (c *checker) after(action Action, err error, now time.Time) *Violation {
+	g, prev := c.g, c.prev
+	c.prev = takeSnapshot(g)
+
+	if len(g.Revealed) != len(g.Layout) {
+		return &Violation{Invariant: "board", Detail: fmt.Sprintf("%d cells but %d revealed flags", len(g.Layout), len(g.Revealed))}
+	}
+	if err != nil && !c.prev.equal(prev) {
+		return &Violation{Invariant: "refused moves change nothing", Detail: fmt.Sprintf("%s was refused (%v) but changed the game", action.Kind, err)}
+	}
+
+	// Phase order: the game only ever moves on one round at a time, and
+	// each round has its phase.
+	if g.Round < 0 || g.Round >= len(phaseOrder) || g.Phase() != phaseOrder[g.Round] {
+		return &Violation{Invariant: "phase order", Detail: fmt.Sprintf("round %d has phase %s", g.Round, g.Phase())}
+	}
+	if g.Round != prev.round && g.Round != (prev.round+1)%len(phaseOrder) {
+		return &Violation{Invariant: "phase order", Detail: fmt.Sprintf("%s moved the game from round %d to round %d", action.Kind, prev.round, g.Round)}
+	}
+
+	// Scores are monotonic: cells stay revealed once they are, so no
+	// team's count of revealed cells ever goes down.
+	for i, was := range prev.revealed {
+		if was && !g.Revealed[i] {
+			return &Violation{Invariant: "scores monotonic", Detail: fmt.Sprintf("cell %d was hidden again", i)}
+		}
+	}
+
+	// The guess timer only runs while a team is guessing, and starts
+	// afresh each time one does.
+	phase := g.Phase()
+	guessing := phase == trapwords.PhaseBlueGuessing || phase == trapwords.PhaseRedGuessing
+	if guessing != (g.GuessEnd != 0) {
+		return &Violation{Invariant: "timer only during guessing", Detail: fmt.Sprintf("round %d (%s) has guessEnd %d", g.Round, phase, g.GuessEnd)}
+	}
+	if guessing && g.Round != prev.round && g.GuessEnd <= now.Unix() {
+		return &Violation{Invariant: "timer only during guessing", Detail: fmt.Sprintf("round %d started with its timer already run out", g.Round)}
+	}
+
+	// The winner is decided exactly once: as soon as it should be. Run
+	// checks it isn't decided again.
+	if g.WinningTeam == nil && decided(g) {
+		return &Violation{Invariant: "winner decided once", Detail: "the game should be over but has no winner"}
+	}
+	return nil
+}
+
+// decided reports whether the cells revealed so far settle the game.
+func decided(g *trapwords.Game) bool {
+	remaining := make(map[trapwords.Team]int)
+	for i, t := range g.Layout {
+		if g.Revealed[i] && t == trapwords.Black {
+			return true
+		}
+		if !g.Revealed[i] {
+			remaining[t]++
+		}
+	}
+	return remaining[trapwords.Red] == 0 || remaining[trapwords.Blue] == 0
+}
@@ -0,0 +1,111 @@
+package simulation
+
+import (
+	"flag"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/banool/trapwords"
+)
+
+var games = flag.Int("games", 200, "number of random games to simulate")
+
+func TestRandomGames(t *testing.T) {
+	finished := 0
+	for seed := int64(1); seed <= int64(*games); seed++ {
+		res, err := Run(DefaultConfig(seed))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.Winner != nil {
+			finished++
+		}
+	}
+	if finished == 0 {
+		t.Errorf("none of %d games finished", *games)
+	}
+}
+
+func TestSameSeedSameGame(t *testing.T) {
+	a, err := Run(DefaultConfig(42))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := Run(DefaultConfig(42))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Steps != b.Steps || a.Refused != b.Refused || a.Game.Round != b.Game.Round ||
+		a.Game.GuessEnd != b.Game.GuessEnd || a.Game.RoundWords[0] != b.Game.RoundWords[0] {
+		t.Errorf("seed 42 played out differently twice")
+	}
+}
+
+func TestScriptedMistakes(t *testing.T) {
+	cfg := DefaultConfig(1)
+	cfg.Players = 2
+	cfg.Bot = func(i int) Bot {
+		if i == 1 {
+			// Blue only watches.
+			return BotFunc(func(*trapwords.Game, *trapwords.Player, time.Time, *rand.Rand) Action {
+				return Action{Kind: Wait}
+			})
+		}
+		return &ScriptedBot{Actions: []Action{
+			{Kind: EndTurn},           // red ends the trapwords phase
+			{Kind: EndTurn},           // but it's blue's turn to get ready
+			{Kind: Guess, Index: 0},   // and nobody is guessing
+			{Kind: Guess, Index: 100}, // nor is there a cell 100
+		}}
+	}
+	cfg.MaxSteps = 10
+
+	res, err := Run(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Game.Phase() != trapwords.PhaseBlueReady || res.Refused != 3 {
+		t.Errorf("got phase %s with %d moves refused, want %s with 3", res.Game.Phase(), res.Refused, trapwords.PhaseBlueReady)
+	}
+}
+
+func TestTooFewPlayers(t *testing.T) {
+	for _, n := range []int{-1, 0, 1} {
+		cfg := DefaultConfig(1)
+		cfg.Players = n
+		if _, err := Run(cfg); err == nil {
+			t.Errorf("a game of %d players ran, want an error", n)
+		}
+	}
+}
+
+// TestGuessingBlack has the blue team guess the black cell as soon as
+// it can, which should hand red the game.
+func TestGuessingBlack(t *testing.T) {
+	cfg := DefaultConfig(3)
+	cfg.Bot = func(i int) Bot {
+		return BotFunc(func(g *trapwords.Game, p *trapwords.Player, now time.Time, rnd *rand.Rand) Action {
+			if g.Phase() == trapwords.PhaseBlueGuessing && p.Team == trapwords.Blue && p.ID != g.Cluegiver {
+				for i, team := range g.Layout {
+					if team == trapwords.Black {
+						return Action{Kind: Guess, Index: i}
+					}
+				}
+			}
+			// Nobody else guesses, so blue gets to.
+			if g.Phase() == trapwords.PhaseRedGuessing {
+				return Action{Kind: EndTurn}
+			}
+			return RandomBot{}.Act(g, p, now, rnd)
+		})
+	}
+
+	res, err := Run(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Winner == nil || *res.Winner != trapwords.Red {
+		t.Errorf("winner is %v, want red", res.Winner)
+	}
+}
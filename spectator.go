@@ -0,0 +1,74 @@
+package trapwords
+
+import (
+	"net/http"
+	"time"
+)
+
+// spectate makes playerID a spectator, who has no team and can only
+// watch, or a player again if spectating is false.
+func (g *Game) spectate(playerID string, spectating bool, now time.Time) {
+	p, ok := g.Players[playerID]
+	if !ok {
+		return
+	}
+	p.Spectator = spectating
+	if spectating {
+		p.Team = Neutral
+		if g.Cluegiver == playerID {
+			g.Cluegiver = ""
+		}
+	}
+	g.pickHost(now)
+}
+
+// spectators counts the spectators still watching.
+func (g *Game) spectators(now time.Time) int {
+	n := 0
+	for _, p := range g.Players {
+		if p.Spectator && p.present(now) {
+			n++
+		}
+	}
+	return n
+}
+
+// spectatorWords returns the round's words as spectators see them: each
+// is blank until the turn guessing it is over, so nobody watching can
+// tell a team its word. Red guesses the first word and blue the second.
+// Once the game is over, every word is shown.
+func (g *Game) spectatorWords() []string {
+	words := make([]string, len(g.RoundWords))
+	if g.WinningTeam != nil {
+		copy(words, g.RoundWords)
+		return words
+	}
+	// Look back over the rounds since the words were dealt.
+	dealt := g.Round
+	for !newWordsRound(dealt) {
+		dealt--
+	}
+	for round := dealt; round < g.Round; round++ {
+		i := -1
+		switch phaseOf(round) {
+		case PhaseRedGuessing:
+			i = 0
+		case PhaseBlueGuessing:
+			i = 1
+		}
+		if i >= 0 && i < len(words) {
+			words[i] = g.RoundWords[i]
+		}
+	}
+	return words
+}
+
+// requirePlayer writes a 403 and returns false if sess belongs to a
+// spectator, who may only watch.
+func requirePlayer(rw http.ResponseWriter, g *Game, sess session) bool {
+	if p, ok := g.Players[sess.PlayerID]; ok && p.Spectator {
+		writeError(rw, http.StatusForbidden, "spectator", "Spectators can only watch")
+		return false
+	}
+	return true
+}
@@ -0,0 +1,237 @@
+package trapwords
+
+import (
+	"encoding/gob"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Store persists games so they survive a process restart.
+type Store interface {
+	SaveGame(g *Game) error
+	DeleteGame(id string) error
+	LoadGames() ([]*Game, error)
+	// SaveRecord keeps the record of a finished game, and LoadRecords
+	// returns every record kept.
+	SaveRecord(r *GameRecord) error
+	LoadRecords() ([]*GameRecord, error)
+	SaveProfile(p *Profile) error
+	LoadProfiles() ([]*Profile, error)
+	// Ping reports whether the store is currently usable.
+	Ping() error
+}
+
+func newStore(cfg StorageConfig) (Store, error) {
+	switch cfg.Backend {
+	case "", "memory":
+		return memoryStore{}, nil
+	case "file":
+		if err := os.MkdirAll(cfg.Path, 0755); err != nil {
+			return nil, err
+		}
+		for _, dir := range []string{recordsDir, profilesDir} {
+			if err := os.MkdirAll(filepath.Join(cfg.Path, dir), 0755); err != nil {
+				return nil, err
+			}
+		}
+		return fileStore{dir: cfg.Path}, nil
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", cfg.Backend)
+	}
+}
+
+// memoryStore keeps nothing; the server's own map is the only copy.
+type memoryStore struct{}
+
+func (memoryStore) SaveGame(*Game) error        { return nil }
+func (memoryStore) DeleteGame(string) error     { return nil }
+func (memoryStore) LoadGames() ([]*Game, error) { return nil, nil }
+func (memoryStore) Ping() error                 { return nil }
+
+func (memoryStore) SaveRecord(*GameRecord) error        { return nil }
+func (memoryStore) LoadRecords() ([]*GameRecord, error) { return nil, nil }
+func (memoryStore) SaveProfile(*Profile) error          { return nil }
+func (memoryStore) LoadProfiles() ([]*Profile, error)   { return nil, nil }
+
+const gameFileExt = ".gob"
+
+// recordsDir is the subdirectory the file store keeps game records in,
+// as JSON so they can be read without the server.
+const recordsDir = "records"
+
+// profilesDir is the subdirectory the file store keeps profiles in.
+const profilesDir = "profiles"
+
+// fileStore writes each game to its own gob-encoded file. Game IDs
+// come straight from URLs, so file names are hex-encoded IDs.
+type fileStore struct {
+	dir string
+}
+
+func (fs fileStore) path(id string) string {
+	return filepath.Join(fs.dir, hex.EncodeToString([]byte(id))+gameFileExt)
+}
+
+func (fs fileStore) SaveGame(g *Game) error {
+	// Games using the default word list share the server's copy, which
+	// it gives back to them when they're loaded, so there's no need to
+	// write it out with every save.
+	if g.WordSource == defaultWordSource {
+		room := *g.Room
+		room.Words = nil
+		saved := *g
+		saved.Room = &room
+		g = &saved
+	}
+	return writeAtomically(fs.path(g.ID), func(w io.Writer) error {
+		return gob.NewEncoder(w).Encode(g)
+	})
+}
+
+// writeAtomically writes path with write, through a temporary file so
+// a crash never leaves a half-written file behind.
+func writeAtomically(path string, write func(io.Writer) error) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), "tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if err := write(f); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+func (fs fileStore) DeleteGame(id string) error {
+	err := os.Remove(fs.path(id))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (fs fileStore) Ping() error {
+	info, err := os.Stat(fs.dir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", fs.dir)
+	}
+	return nil
+}
+
+func (fs fileStore) LoadGames() ([]*Game, error) {
+	entries, err := ioutil.ReadDir(fs.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var games []*Game
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), gameFileExt) {
+			continue
+		}
+		g, err := fs.load(filepath.Join(fs.dir, e.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("loading %s: %s", e.Name(), err)
+		}
+		games = append(games, g)
+	}
+	return games, nil
+}
+
+func (fs fileStore) load(path string) (*Game, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	// gob encodes the room's fields as the game's own, so the game
+	// needs a room to decode them into.
+	g := Game{Room: new(Room)}
+	if err := gob.NewDecoder(f).Decode(&g); err != nil {
+		return nil, err
+	}
+	return &g, nil
+}
+
+func (fs fileStore) SaveRecord(r *GameRecord) error {
+	// A game ID is reused for each new game, so the end time keeps
+	// their records apart.
+	name := fmt.Sprintf("%s-%d.json", hex.EncodeToString([]byte(r.ID)), r.EndedAt.UnixNano())
+	return writeAtomically(filepath.Join(fs.dir, recordsDir, name), func(w io.Writer) error {
+		return json.NewEncoder(w).Encode(r)
+	})
+}
+
+func (fs fileStore) LoadRecords() ([]*GameRecord, error) {
+	dir := filepath.Join(fs.dir, recordsDir)
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var records []*GameRecord
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), ".json") {
+			continue
+		}
+		b, err := ioutil.ReadFile(filepath.Join(dir, e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		var r GameRecord
+		if err := json.Unmarshal(b, &r); err != nil {
+			return nil, fmt.Errorf("loading %s: %s", e.Name(), err)
+		}
+		records = append(records, &r)
+	}
+	return records, nil
+}
+
+func (fs fileStore) SaveProfile(p *Profile) error {
+	path := filepath.Join(fs.dir, profilesDir, hex.EncodeToString([]byte(p.ID))+gameFileExt)
+	return writeAtomically(path, func(w io.Writer) error {
+		return gob.NewEncoder(w).Encode(p)
+	})
+}
+
+func (fs fileStore) LoadProfiles() ([]*Profile, error) {
+	dir := filepath.Join(fs.dir, profilesDir)
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var profiles []*Profile
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), gameFileExt) {
+			continue
+		}
+		f, err := os.Open(filepath.Join(dir, e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		var p Profile
+		err = gob.NewDecoder(f).Decode(&p)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("loading %s: %s", e.Name(), err)
+		}
+		profiles = append(profiles, &p)
+	}
+	return profiles, nil
+}